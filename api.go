@@ -0,0 +1,269 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// apiV1 serves everything under /api/v1/.
+func apiV1() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/now-playing", apiNowPlaying)
+	mux.HandleFunc("GET /api/v1/dj", apiDJ)
+	mux.HandleFunc("GET /api/v1/listeners", apiListeners)
+	mux.HandleFunc("GET /api/v1/history", apiHistory)
+	mux.HandleFunc("GET /api/v1/songs", apiSongs)
+	mux.HandleFunc("GET /api/v1/songs/{id}", apiSong)
+	mux.HandleFunc("GET /api/v1/artists/{id}", apiArtist)
+	mux.HandleFunc("GET /api/v1/users/{name}", apiUser)
+	mux.HandleFunc("GET /api/v1/me", apiMe)
+	mux.HandleFunc("GET /api/v1/users/{name}/faves", apiFaves)
+	mux.HandleFunc("PUT /api/v1/songs/{id}/fave", apiSetFave)
+	mux.HandleFunc("DELETE /api/v1/songs/{id}/fave", apiSetFave)
+	handleUpload(mux, "POST /api/v1/uploads", apiUpload)
+	mux.HandleFunc("POST /api/v1/songs/{id}/request", requireLogin(apiRequest))
+	mux.HandleFunc("GET /api/v1/requests", apiQueue)
+	handleBackend(mux, "POST /api/v1/requests/next", apiPickRequest)
+	mux.HandleFunc("GET /api/v1/stats/plays/daily", apiDailyPlays)
+	mux.HandleFunc("GET /api/v1/stats/plays/hourly", apiHourlyPlays)
+	mux.HandleFunc("GET /api/v1/stats/top/songs", apiTopSongs)
+	mux.HandleFunc("GET /api/v1/stats/top/artists", apiTopArtists)
+	mux.HandleFunc("GET /api/v1/stats/djs", apiDJStats)
+	mux.HandleFunc("GET /api/v1/stats/never-played", apiNeverPlayed)
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	})
+	return mux
+}
+
+// The API has its own types rather than serialising the models, so that
+// nothing like password hashes gets out by accident.
+
+type apiNowPlayingResponse struct {
+	Artist    string     `json:"artist"`
+	Title     string     `json:"title"`
+	DJ        string     `json:"dj"`
+	Listeners int        `json:"listeners"`
+	Peak      int        `json:"peak"`
+	Since     *time.Time `json:"since,omitempty"`
+	Thread    string     `json:"thread,omitempty"`
+}
+
+type apiArtistResponse struct {
+	ID    uint              `json:"id"`
+	Name  string            `json:"name"`
+	Songs []apiSongResponse `json:"songs,omitempty"`
+}
+
+type apiSongResponse struct {
+	ID     uint               `json:"id"`
+	Title  string             `json:"title"`
+	Artist *apiArtistResponse `json:"artist,omitempty"`
+}
+
+type apiPlayResponse struct {
+	Song   apiSongResponse `json:"song"`
+	DJ     string          `json:"dj"`
+	Played time.Time       `json:"played"`
+}
+
+type apiUserResponse struct {
+	Username string    `json:"username"`
+	Joined   time.Time `json:"joined"`
+	Roles    []string  `json:"roles"`
+	IRC      []string  `json:"irc"`
+	Discord  []string  `json:"discord"`
+}
+
+func newAPISong(song models.Song) apiSongResponse {
+	s := apiSongResponse{
+		ID:    song.ID,
+		Title: song.Title,
+	}
+	if song.Artist.ID != 0 {
+		s.Artist = &apiArtistResponse{
+			ID:   song.Artist.ID,
+			Name: song.Artist.Name,
+		}
+	}
+	return s
+}
+
+func newAPINowPlaying(np NowPlaying) apiNowPlayingResponse {
+	resp := apiNowPlayingResponse{
+		Artist:    np.Artist,
+		Title:     np.Title,
+		DJ:        np.DJ,
+		Listeners: np.Listeners,
+		Peak:      np.Peak,
+		Thread:    np.Thread,
+	}
+	if !np.Since.IsZero() {
+		resp.Since = &np.Since
+	}
+	return resp
+}
+
+func apiNowPlaying(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newAPINowPlaying(CurrentlyPlaying()))
+}
+
+func apiDJ(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"dj": CurrentlyPlaying().DJ})
+}
+
+func apiListeners(w http.ResponseWriter, r *http.Request) {
+	np := CurrentlyPlaying()
+	writeJSON(w, http.StatusOK, map[string]int{
+		"listeners": np.Listeners,
+		"peak":      np.Peak,
+	})
+}
+
+func apiHistory(w http.ResponseWriter, r *http.Request) {
+	var plays []models.PlayHistory
+	limit := intParam(r, "limit", defaultHistoryLimit, maxHistoryLimit)
+	if err := db.Preload("Song").Preload("Song.Artist").Order("played desc").Limit(limit).Find(&plays).Error; err != nil {
+		log.Printf("Error fetching play history: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't fetch the play history")
+		return
+	}
+	djs, err := usernames(plays)
+	if err != nil {
+		log.Printf("Error fetching DJs: %s\n", err)
+	}
+	resp := []apiPlayResponse{}
+	for _, play := range plays {
+		resp = append(resp, apiPlayResponse{
+			Song:   newAPISong(play.Song),
+			DJ:     djs[play.DJ],
+			Played: play.Played,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// usernames looks up the DJs of some plays, by user ID.
+func usernames(plays []models.PlayHistory) (map[uint]string, error) {
+	names := make(map[uint]string)
+	var ids []uint
+	for _, play := range plays {
+		ids = append(ids, play.DJ)
+	}
+	if len(ids) == 0 {
+		return names, nil
+	}
+	var users []models.User
+	if err := db.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+		return names, err
+	}
+	for _, user := range users {
+		names[user.ID] = user.Username
+	}
+	return names, nil
+}
+
+// idParam reads a numeric ID from the path, writing a 404 if it isn't one.
+func idParam(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func apiSong(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+	song, ok := findLibrarySong(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such song")
+		return
+	}
+	resp := newAPILibrarySong(*song)
+	var err error
+	if resp.FavedBy, err = favedBy(song.ID); err != nil {
+		log.Printf("Error fetching faves of song %d: %s\n", song.ID, err)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func apiArtist(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(w, r)
+	if !ok {
+		return
+	}
+	var artist models.Artist
+	if db.Preload("Songs").First(&artist, id).RecordNotFound() {
+		writeError(w, http.StatusNotFound, "no such artist")
+		return
+	}
+	resp := apiArtistResponse{
+		ID:    artist.ID,
+		Name:  artist.Name,
+		Songs: []apiSongResponse{},
+	}
+	for _, song := range artist.Songs {
+		resp.Songs = append(resp.Songs, newAPISong(song))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func apiUser(w http.ResponseWriter, r *http.Request) {
+	var user models.User
+	if db.Where("username = ?", r.PathValue("name")).First(&user).RecordNotFound() {
+		writeError(w, http.StatusNotFound, "no such user")
+		return
+	}
+	resp := apiUserResponse{
+		Username: user.Username,
+		Joined:   user.CreatedAt,
+		Roles:    []string{},
+		IRC:      []string{},
+		Discord:  []string{},
+	}
+	if err := db.Model(&user).Association("Roles").Find(&user.Roles).Error; err != nil {
+		log.Printf("Error fetching roles for %s: %s\n", user.Username, err)
+	}
+	for _, role := range user.Roles {
+		resp.Roles = append(resp.Roles, role.Name)
+	}
+	ids, err := linkedIdentities(&user)
+	if err != nil {
+		log.Printf("Error fetching linked identities for %s: %s\n", user.Username, err)
+	}
+	for _, id := range ids {
+		if id.Platform == "irc" {
+			resp.IRC = append(resp.IRC, id.Name)
+		} else {
+			resp.Discord = append(resp.Discord, id.Name)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// apiMe says who's logged in. Scripts on our own pages get the CSRF token
+// from the csrf-token meta tag; we don't hand it out here, where other
+// origins might be able to read it.
+func apiMe(w http.ResponseWriter, r *http.Request) {
+	session, ok := requestSession(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"username": session.User.Username,
+	})
+}
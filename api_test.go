@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erikstmartin/go-testdb"
+	"github.com/jinzhu/gorm"
+)
+
+// withTestDB points db at a stub database that answers queries with query,
+// for the rest of the test.
+func withTestDB(t *testing.T, query func(query string, args []driver.Value) (driver.Rows, error)) {
+	testdb.SetQueryWithArgsFunc(query)
+	testDB, err := gorm.Open("testdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = testDB
+	t.Cleanup(func() {
+		db = old
+		testDB.Close()
+		testdb.Reset()
+	})
+}
+
+func TestAPIRoutes(t *testing.T) {
+	withTestDB(t, func(query string, args []driver.Value) (driver.Rows, error) {
+		if strings.Contains(query, "songs.id = ?") && len(args) == 1 && args[0] == int64(42) {
+			return testdb.RowsFromCSVString(
+				[]string{"id", "title", "album", "duration", "artist_id", "artist_name", "plays", "faves"},
+				"42,Song,Album,180,7,Artist,3,1"), nil
+		}
+		return testdb.RowsFromCSVString([]string{"id"}, ""), nil
+	})
+	api := apiV1()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/songs/42", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/songs/42 = %d %s, want 200", w.Code, w.Body)
+	}
+	var song apiLibrarySong
+	if err := json.Unmarshal(w.Body.Bytes(), &song); err != nil {
+		t.Fatal(err)
+	}
+	if song.ID != 42 || song.Title != "Song" || song.Artist.Name != "Artist" {
+		t.Errorf("got %+v, want song 42", song)
+	}
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/api/v1/songs/43", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/songs/nope", http.StatusNotFound},
+		{http.MethodPut, "/api/v1/songs/42/fave", http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/nope", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// audioInfo is what we can tell about an uploaded song without decoding it.
+type audioInfo struct {
+	// "mp3", "vorbis", "opus" or "flac".
+	Format   string
+	Title    string
+	Artist   string
+	Album    string
+	Duration time.Duration
+	// The SHA-256 of the audio alone, leaving out the tags, so that a
+	// retagged copy of a song still matches.
+	Hash string
+}
+
+var errUnknownFormat = errors.New("not an MP3, Ogg Vorbis, Opus or FLAC file")
+
+// audioExtensions are what we name files of each format.
+var audioExtensions = map[string]string{
+	"mp3":    ".mp3",
+	"vorbis": ".ogg",
+	"opus":   ".opus",
+	"flac":   ".flac",
+}
+
+// probeAudio works out what's in f from its contents, ignoring whatever it
+// claims to be.
+func probeAudio(f io.ReadSeeker, size int64) (*audioInfo, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return nil, errUnknownFormat
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(magic[:]) == "OggS":
+		return probeOgg(f)
+	case string(magic[:]) == "fLaC":
+		return probeFLAC(f)
+	case string(magic[:3]) == "ID3", magic[0] == 0xFF && magic[1]&0xE0 == 0xE0:
+		return probeMP3(f, size)
+	}
+	return nil, errUnknownFormat
+}
+
+// MP3
+
+const (
+	id3HeaderLength = 10
+	id3v1Length     = 128
+	// How far past the ID3 tag we'll look for the first frame.
+	maxMP3Junk = 4096
+)
+
+var (
+	mp3Bitrates = [2][16]int{
+		// MPEG 1 layer III
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		// MPEG 2 and 2.5 layer III
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+type mp3Frame struct {
+	mpeg1      bool
+	mono       bool
+	bitrate    int
+	sampleRate int
+	length     int
+}
+
+// parseMP3Frame reads a layer III frame header. Anything else, including
+// other MPEG layers, isn't an MP3 as far as we're concerned.
+func parseMP3Frame(b []byte) (mp3Frame, bool) {
+	var f mp3Frame
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return f, false
+	}
+	version := b[1] >> 3 & 3
+	layer := b[1] >> 1 & 3
+	bitrateIndex := b[2] >> 4
+	rateIndex := b[2] >> 2 & 3
+	if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return f, false
+	}
+	f.mpeg1 = version == 3
+	f.mono = b[3]>>6 == 3
+	f.sampleRate = mp3SampleRates[rateIndex]
+	table := 0
+	switch version {
+	case 2:
+		f.sampleRate /= 2
+		table = 1
+	case 0:
+		f.sampleRate /= 4
+		table = 1
+	}
+	f.bitrate = mp3Bitrates[table][bitrateIndex] * 1000
+	padding := int(b[2] >> 1 & 1)
+	if f.mpeg1 {
+		f.length = 144*f.bitrate/f.sampleRate + padding
+	} else {
+		f.length = 72*f.bitrate/f.sampleRate + padding
+	}
+	return f, true
+}
+
+func (f mp3Frame) samples() int {
+	if f.mpeg1 {
+		return 1152
+	}
+	return 576
+}
+
+// sideInfoLength is how far into the frame a Xing header would be, after the
+// frame header.
+func (f mp3Frame) sideInfoLength() int {
+	switch {
+	case f.mpeg1 && f.mono:
+		return 17
+	case f.mpeg1:
+		return 32
+	case f.mono:
+		return 9
+	}
+	return 17
+}
+
+func probeMP3(f io.ReadSeeker, size int64) (*audioInfo, error) {
+	info := &audioInfo{Format: "mp3"}
+	start, end := int64(0), size
+
+	var header [id3HeaderLength]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return nil, errUnknownFormat
+	}
+	if string(header[:3]) == "ID3" {
+		tagLength := int64(syncsafe(header[6:10]))
+		if id3HeaderLength+tagLength > size {
+			return nil, fmt.Errorf("the ID3 tag is cut off")
+		}
+		tag := make([]byte, tagLength)
+		if _, err := io.ReadFull(f, tag); err != nil {
+			return nil, fmt.Errorf("the ID3 tag is cut off")
+		}
+		readID3v2(info, header[3], header[5], tag)
+		start = id3HeaderLength + tagLength
+		// A footer repeats the header.
+		if header[5]&0x10 != 0 {
+			start += id3HeaderLength
+		}
+	}
+
+	// ID3v1 lives in the last 128 bytes, and fills in anything ID3v2 didn't.
+	if size-start >= id3v1Length {
+		tag := make([]byte, id3v1Length)
+		if _, err := f.Seek(size-id3v1Length, io.SeekStart); err == nil {
+			if _, err := io.ReadFull(f, tag); err == nil && string(tag[:3]) == "TAG" {
+				end -= id3v1Length
+				fill(&info.Title, latin1(tag[3:33]))
+				fill(&info.Artist, latin1(tag[33:63]))
+				fill(&info.Album, latin1(tag[63:93]))
+			}
+		}
+	}
+
+	// Find the first frame, allowing for a bit of padding after the tag.
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMP3Junk)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+	var frame mp3Frame
+	found := false
+	for i := 0; i+4 <= len(buf); i++ {
+		if frame, found = parseMP3Frame(buf[i:]); found {
+			start += int64(i)
+			buf = buf[i:]
+			break
+		}
+	}
+	if !found {
+		return nil, errUnknownFormat
+	}
+	// One frame header could be chance, two in a row isn't.
+	if start+int64(frame.length)+4 <= end {
+		next := make([]byte, 4)
+		if _, err := f.Seek(start+int64(frame.length), io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(f, next); err != nil {
+			return nil, errUnknownFormat
+		}
+		if _, ok := parseMP3Frame(next); !ok {
+			return nil, errUnknownFormat
+		}
+	}
+
+	// VBR files say how many frames they have in a Xing or VBRI header.
+	// Otherwise it's constant bitrate and the size tells us.
+	var frames int64
+	xing := 4 + frame.sideInfoLength()
+	if len(buf) >= xing+12 && (string(buf[xing:xing+4]) == "Xing" || string(buf[xing:xing+4]) == "Info") && buf[xing+7]&1 != 0 {
+		frames = int64(binary.BigEndian.Uint32(buf[xing+8 : xing+12]))
+	} else if len(buf) >= 36+18 && string(buf[36:40]) == "VBRI" {
+		frames = int64(binary.BigEndian.Uint32(buf[36+14 : 36+18]))
+	}
+	// Every frame takes more than its 4 byte header, so a count the file
+	// couldn't hold is made up.
+	if frames > 0 && frames <= (end-start)/4 {
+		info.Duration = samplesDuration(frames*int64(frame.samples()), frame.sampleRate)
+	} else {
+		info.Duration = samplesDuration((end-start)*8, frame.bitrate)
+	}
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, f, end-start); err != nil {
+		return nil, err
+	}
+	info.Hash = hex.EncodeToString(hash.Sum(nil))
+	return info, nil
+}
+
+// samplesDuration is how long n samples last at rate samples a second,
+// saturating rather than overflowing for nonsense like a corrupt header.
+func samplesDuration(n int64, rate int) time.Duration {
+	if n <= 0 || rate <= 0 {
+		return 0
+	}
+	seconds := n / int64(rate)
+	if seconds >= math.MaxInt64/int64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds)*time.Second + time.Duration(n%int64(rate))*time.Second/time.Duration(rate)
+}
+
+func syncsafe(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<7 | int(c&0x7F)
+	}
+	return n
+}
+
+// readID3v2 picks the title, artist and album out of an ID3v2.2, 2.3 or 2.4
+// tag, not including its header.
+func readID3v2(info *audioInfo, version, flags byte, tag []byte) {
+	// Unsynchronisation stuffs a zero after every 0xFF.
+	if flags&0x80 != 0 {
+		tag = bytes.Replace(tag, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+	}
+	if flags&0x40 != 0 && version >= 3 && len(tag) >= 4 {
+		skip := int(binary.BigEndian.Uint32(tag[:4])) + 4
+		if version == 4 {
+			skip = syncsafe(tag[:4])
+		}
+		if skip > len(tag) {
+			return
+		}
+		tag = tag[skip:]
+	}
+	idLength, headerLength := 4, 10
+	if version == 2 {
+		idLength, headerLength = 3, 6
+	}
+	for len(tag) >= headerLength && tag[0] != 0 {
+		id := string(tag[:idLength])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			size = syncsafe(tag[4:8])
+		}
+		if size < 0 || headerLength+size > len(tag) {
+			return
+		}
+		body := tag[headerLength : headerLength+size]
+		tag = tag[headerLength+size:]
+		switch id {
+		case "TIT2", "TT2":
+			fill(&info.Title, id3Text(body))
+		case "TPE1", "TP1":
+			fill(&info.Artist, id3Text(body))
+		case "TALB", "TAL":
+			fill(&info.Album, id3Text(body))
+		}
+	}
+}
+
+// id3Text decodes a text frame, keeping only the first value if there are
+// several.
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	encoding, b := b[0], b[1:]
+	switch encoding {
+	case 0:
+		return firstValue(latin1(b))
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			bigEndian, b = true, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			bigEndian, b = false, b[2:]
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+		}
+		return firstValue(string(utf16.Decode(units)))
+	}
+	return firstValue(string(b))
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return strings.TrimRight(string(runes), "\x00 ")
+}
+
+func firstValue(s string) string {
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// fill sets *field to value, unless it's already set.
+func fill(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// Ogg Vorbis and Opus
+
+func probeOgg(f io.Reader) (*audioInfo, error) {
+	o := newOggReader(f)
+	o.keepHeaders = true
+	first, err := o.ReadPacket()
+	if err != nil {
+		return nil, errUnknownFormat
+	}
+	info := &audioInfo{}
+	var (
+		headers    int
+		sampleRate int
+		preSkip    int
+		comments   []byte
+	)
+	switch {
+	case len(first) >= 16 && string(first[:7]) == "\x01vorbis":
+		info.Format, headers = "vorbis", 3
+		sampleRate = int(binary.LittleEndian.Uint32(first[12:16]))
+	case len(first) >= 19 && string(first[:8]) == "OpusHead":
+		// Opus always runs at 48kHz, whatever the input was.
+		info.Format, headers, sampleRate = "opus", 2, 48000
+		preSkip = int(binary.LittleEndian.Uint16(first[10:12]))
+	default:
+		return nil, errUnknownFormat
+	}
+
+	hash := sha256.New()
+	for i := 1; ; i++ {
+		packet, err := o.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the file is cut off or corrupt")
+		}
+		switch {
+		case i == 1 && info.Format == "vorbis" && bytes.HasPrefix(packet, []byte("\x03vorbis")):
+			comments = packet[7:]
+		case i == 1 && info.Format == "opus" && bytes.HasPrefix(packet, []byte("OpusTags")):
+			comments = packet[8:]
+		case i >= headers:
+			hash.Write(packet)
+		}
+	}
+	readVorbisComments(info, comments)
+	info.Duration = samplesDuration(o.granule-int64(preSkip), sampleRate)
+	info.Hash = hex.EncodeToString(hash.Sum(nil))
+	return info, nil
+}
+
+// readVorbisComments reads the tags that Vorbis, Opus and FLAC all share.
+func readVorbisComments(info *audioInfo, b []byte) {
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, false
+		}
+		s := b[4 : 4+n]
+		b = b[4+n:]
+		return s, true
+	}
+	// The vendor string.
+	if _, ok := next(); !ok || len(b) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return
+		}
+		parts := strings.SplitN(string(comment), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.ToUpper(parts[0]) {
+		case "TITLE":
+			fill(&info.Title, value)
+		case "ARTIST":
+			fill(&info.Artist, value)
+		case "ALBUM":
+			fill(&info.Album, value)
+		}
+	}
+}
+
+// FLAC
+
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+)
+
+func probeFLAC(f io.Reader) (*audioInfo, error) {
+	info := &audioInfo{Format: "flac"}
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return nil, errUnknownFormat
+	}
+	sawStreamInfo := false
+	for last := false; !last; {
+		var header [4]byte
+		if _, err := io.ReadFull(f, header[:]); err != nil {
+			return nil, fmt.Errorf("the file is cut off or corrupt")
+		}
+		last = header[0]&0x80 != 0
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		block := make([]byte, length)
+		if _, err := io.ReadFull(f, block); err != nil {
+			return nil, fmt.Errorf("the file is cut off or corrupt")
+		}
+		switch header[0] & 0x7F {
+		case flacStreamInfo:
+			if length < 18 {
+				return nil, errUnknownFormat
+			}
+			sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+			samples := int64(block[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+			info.Duration = samplesDuration(samples, sampleRate)
+			sawStreamInfo = true
+		case flacVorbisComment:
+			readVorbisComments(info, block)
+		}
+	}
+	if !sawStreamInfo {
+		return nil, errUnknownFormat
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	info.Hash = hex.EncodeToString(hash.Sum(nil))
+	return info, nil
+}
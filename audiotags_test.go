@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProbeAudio(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     []byte
+		format   string
+		title    string
+		artist   string
+		album    string
+		duration time.Duration
+		wantErr  bool
+	}{
+		{
+			name:     "mp3 without tags",
+			file:     mp3File(nil, 10, nil),
+			format:   "mp3",
+			duration: samplesDuration(10*mp3FrameLength*8, 128000),
+		},
+		{
+			name:     "mp3 with ID3v2.2",
+			file:     mp3File(id3v2(2, "TT2", "Song", "TP1", "Artist", "TAL", "Album"), 10, nil),
+			format:   "mp3",
+			title:    "Song",
+			artist:   "Artist",
+			album:    "Album",
+			duration: samplesDuration(10*mp3FrameLength*8, 128000),
+		},
+		{
+			name:     "mp3 with ID3v2.3",
+			file:     mp3File(id3v2(3, "TIT2", "Song", "TPE1", "Artist", "TALB", "Album"), 10, nil),
+			format:   "mp3",
+			title:    "Song",
+			artist:   "Artist",
+			album:    "Album",
+			duration: samplesDuration(10*mp3FrameLength*8, 128000),
+		},
+		{
+			name:     "mp3 with ID3v2.4",
+			file:     mp3File(id3v2(4, "TIT2", "Sóng", "TPE1", "Ärtist"), 10, nil),
+			format:   "mp3",
+			title:    "Sóng",
+			artist:   "Ärtist",
+			duration: samplesDuration(10*mp3FrameLength*8, 128000),
+		},
+		{
+			name:     "mp3 with ID3v1",
+			file:     append(mp3File(nil, 10, nil), id3v1("Song", "Artist", "Album")...),
+			format:   "mp3",
+			title:    "Song",
+			artist:   "Artist",
+			album:    "Album",
+			duration: samplesDuration(10*mp3FrameLength*8, 128000),
+		},
+		{
+			name:     "mp3 with a Xing header",
+			file:     mp3File(nil, 10, xingHeader(800)),
+			format:   "mp3",
+			duration: samplesDuration(800*1152, 44100),
+		},
+		{
+			name:     "mp3 with a VBRI header",
+			file:     mp3File(nil, 10, vbriHeader(500)),
+			format:   "mp3",
+			duration: samplesDuration(500*1152, 44100),
+		},
+		{
+			name:     "mp3 with more frames than bytes",
+			file:     mp3File(nil, 10, xingHeader(math.MaxUint32)),
+			format:   "mp3",
+			duration: samplesDuration(10*mp3FrameLength*8, 128000),
+		},
+		{
+			name:    "mp3 with an ID3 tag longer than the file",
+			file:    append([]byte("ID3\x03\x00\x00\x7f\x7f\x7f\x7f"), mp3File(nil, 2, nil)...),
+			wantErr: true,
+		},
+		{
+			name:    "mp3 cut off in the ID3 header",
+			file:    []byte("ID3\x03\x00"),
+			wantErr: true,
+		},
+		{
+			name:    "mp3 sync without a second frame",
+			file:    append(mp3File(nil, 1, nil), make([]byte, mp3FrameLength)...),
+			wantErr: true,
+		},
+		{
+			name:     "ogg vorbis",
+			file:     vorbisFile(44100, 441000),
+			format:   "vorbis",
+			title:    "Song",
+			artist:   "Artist",
+			album:    "Album",
+			duration: 10 * time.Second,
+		},
+		{
+			name:     "ogg opus",
+			file:     opusFile(312, 48000*3+312),
+			format:   "opus",
+			title:    "Song",
+			artist:   "Artist",
+			duration: 3 * time.Second,
+		},
+		{
+			name:    "ogg cut off",
+			file:    vorbisFile(44100, 441000)[:100],
+			wantErr: true,
+		},
+		{
+			name:     "flac",
+			file:     flacFile(44100, 44100*5, true),
+			format:   "flac",
+			title:    "Song",
+			artist:   "Artist",
+			album:    "Album",
+			duration: 5 * time.Second,
+		},
+		{
+			name:     "flac with more samples than a Duration holds",
+			file:     flacFile(1, 1<<36-1, true),
+			format:   "flac",
+			title:    "Song",
+			artist:   "Artist",
+			album:    "Album",
+			duration: math.MaxInt64,
+		},
+		{
+			name:    "flac without stream info",
+			file:    flacFile(44100, 44100, false),
+			wantErr: true,
+		},
+		{
+			name:    "flac cut off",
+			file:    flacFile(44100, 44100, true)[:20],
+			wantErr: true,
+		},
+		{
+			name:    "not audio",
+			file:    []byte("<html><body>hello</body></html>"),
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			file:    nil,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := probeAudio(bytes.NewReader(test.file), int64(len(test.file)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Format != test.format {
+				t.Errorf("format = %q, want %q", info.Format, test.format)
+			}
+			if info.Title != test.title || info.Artist != test.artist || info.Album != test.album {
+				t.Errorf("tags = %q, %q, %q, want %q, %q, %q", info.Title, info.Artist, info.Album, test.title, test.artist, test.album)
+			}
+			if info.Duration != test.duration {
+				t.Errorf("duration = %s, want %s", info.Duration, test.duration)
+			}
+			if info.Hash == "" {
+				t.Error("no hash")
+			}
+		})
+	}
+}
+
+func TestProbeAudioHashIgnoresTags(t *testing.T) {
+	plain := mp3File(nil, 10, nil)
+	tagged := append(mp3File(id3v2(3, "TIT2", "Song"), 10, nil), id3v1("Song", "Artist", "Album")...)
+	a, err := probeAudio(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := probeAudio(bytes.NewReader(tagged), int64(len(tagged)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Hash != b.Hash {
+		t.Errorf("retagging changed the hash from %s to %s", a.Hash, b.Hash)
+	}
+}
+
+// MPEG 1 layer III, 128kbps, 44.1kHz, stereo, no padding.
+var mp3FrameHeader = []byte{0xFF, 0xFB, 0x90, 0x00}
+
+const mp3FrameLength = 144 * 128000 / 44100
+
+// mp3File is an ID3v2 tag followed by frames frames, the first of which
+// carries vbr after its side info.
+func mp3File(tag []byte, frames int, vbr []byte) []byte {
+	b := append([]byte(nil), tag...)
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, mp3FrameLength)
+		copy(frame, mp3FrameHeader)
+		if i == 0 && vbr != nil {
+			copy(frame[4+32:], vbr)
+		}
+		// Something for the hash to chew on.
+		frame[len(frame)-1] = byte(i)
+		b = append(b, frame...)
+	}
+	return b
+}
+
+// xingHeader goes after the side info, where the Xing header would be.
+func xingHeader(frames uint32) []byte {
+	b := []byte("Xing\x00\x00\x00\x01")
+	return binary.BigEndian.AppendUint32(b, frames)
+}
+
+// vbriHeader goes at byte 36 of the frame, which for stereo MPEG 1 is
+// straight after the side info, same as Xing.
+func vbriHeader(frames uint32) []byte {
+	b := []byte("VBRI\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	return binary.BigEndian.AppendUint32(b, frames)
+}
+
+// id3v2 is a tag with the given frame IDs and texts, in the frame layout of
+// ID3v2.version.
+func id3v2(version byte, frames ...string) []byte {
+	var body []byte
+	for i := 0; i+1 < len(frames); i += 2 {
+		// UTF-8 for 2.4, which is the only version that has it, and UTF-16
+		// with a BOM otherwise.
+		text := []byte{3}
+		text = append(text, frames[i+1]...)
+		if version < 4 {
+			text = []byte{1, 0xFF, 0xFE}
+			for _, r := range frames[i+1] {
+				text = binary.LittleEndian.AppendUint16(text, uint16(r))
+			}
+		}
+		body = append(body, frames[i]...)
+		switch version {
+		case 2:
+			body = append(body, byte(len(text)>>16), byte(len(text)>>8), byte(len(text)))
+		case 3:
+			body = binary.BigEndian.AppendUint32(body, uint32(len(text)))
+			body = append(body, 0, 0)
+		default:
+			body = append(body, syncsafeBytes(len(text))...)
+			body = append(body, 0, 0)
+		}
+		body = append(body, text...)
+	}
+	// Some padding, like taggers leave.
+	body = append(body, make([]byte, 16)...)
+	header := []byte{'I', 'D', '3', version, 0, 0}
+	return append(append(header, syncsafeBytes(len(body))...), body...)
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+func id3v1(title, artist, album string) []byte {
+	b := make([]byte, id3v1Length)
+	copy(b, "TAG")
+	copy(b[3:33], title)
+	copy(b[33:63], artist)
+	copy(b[63:93], album)
+	return b
+}
+
+func vorbisComments(comments ...string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 4)
+	b = append(b, "test"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(comments)))
+	for _, comment := range comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(comment)))
+		b = append(b, comment...)
+	}
+	return b
+}
+
+func vorbisFile(sampleRate, samples int) []byte {
+	ident := []byte("\x01vorbis\x00\x00\x00\x00\x02")
+	ident = binary.LittleEndian.AppendUint32(ident, uint32(sampleRate))
+	ident = append(ident, make([]byte, 14)...)
+	comments := append([]byte("\x03vorbis"), vorbisComments("TITLE=Song", "artist=Artist", "ALBUM=Album", "GENRE=Test")...)
+	var b []byte
+	b = append(b, oggPage(0, ident)...)
+	b = append(b, oggPage(0, comments, []byte("\x05vorbis setup"))...)
+	b = append(b, oggPage(int64(samples/2), bytes.Repeat([]byte{1}, 300), []byte{2})...)
+	b = append(b, oggPage(int64(samples), []byte{3})...)
+	return b
+}
+
+func opusFile(preSkip, granule int) []byte {
+	head := []byte("OpusHead\x01\x02")
+	head = binary.LittleEndian.AppendUint16(head, uint16(preSkip))
+	head = binary.LittleEndian.AppendUint32(head, 44100)
+	head = append(head, 0, 0, 0)
+	tags := append([]byte("OpusTags"), vorbisComments("TITLE=Song", "ARTIST=Artist")...)
+	var b []byte
+	b = append(b, oggPage(0, head)...)
+	b = append(b, oggPage(0, tags)...)
+	b = append(b, oggPage(int64(granule), []byte{1}, []byte{2})...)
+	return b
+}
+
+// oggPage puts whole packets on a page, which is all the tests need.
+func oggPage(granule int64, packets ...[]byte) []byte {
+	var segments, data []byte
+	for _, packet := range packets {
+		n := len(packet)
+		for ; n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		segments = append(segments, byte(n))
+		data = append(data, packet...)
+	}
+	return rawOggPage(granule, segments, data)
+}
+
+func flacFile(sampleRate int, samples int64, streamInfo bool) []byte {
+	b := []byte("fLaC")
+	if streamInfo {
+		info := make([]byte, 34)
+		info[10] = byte(sampleRate >> 12)
+		info[11] = byte(sampleRate >> 4)
+		info[12] = byte(sampleRate<<4) | 0x02
+		info[13] = byte(samples >> 32 & 0x0F)
+		binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+		b = append(b, flacStreamInfo, 0, 0, byte(len(info)))
+		b = append(b, info...)
+	}
+	comments := vorbisComments("TITLE=Song", "ARTIST=Artist", "ALBUM=Album")
+	b = append(b, 0x80|flacVorbisComment, 0, byte(len(comments)>>8), byte(len(comments)))
+	b = append(b, comments...)
+	return append(b, "frames"...)
+}
@@ -0,0 +1,86 @@
+package commands
+
+import "fmt"
+
+type ArgType int
+
+const (
+	ArgString ArgType = iota
+	ArgInteger
+	ArgBoolean
+	// A user on the platform the command came from. It's passed to the
+	// command as their name.
+	ArgUser
+)
+
+// Arg describes one of a command's arguments, for platforms like Discord that
+// want to know up front.
+type Arg struct {
+	Name        string
+	Description string
+	Type        ArgType
+	// Rest means the argument is free text taking up the rest of the line.
+	Rest bool
+}
+
+// WithArgSpec names and types the command's arguments. Arguments it doesn't
+// cover are plain strings.
+func WithArgSpec(args ...Arg) commandOption {
+	return func(c *Command) error {
+		for i, arg := range args {
+			if arg.Rest && i != len(args)-1 {
+				return fmt.Errorf("only the last argument can take the rest of the line")
+			}
+		}
+		c.args = args
+		return nil
+	}
+}
+
+// Args describes each argument the command takes, filling in any that
+// WithArgSpec didn't with numbered strings. A Rest argument soaks up
+// everything from there on, so it's the last one.
+func (command *Command) Args() []Arg {
+	var args []Arg
+	for i := 0; i < command.maxArgs; i++ {
+		arg := Arg{
+			Name: fmt.Sprintf("arg%d", i+1),
+		}
+		if i < len(command.args) {
+			arg = command.args[i]
+		}
+		args = append(args, arg)
+		if arg.Rest {
+			break
+		}
+	}
+	return args
+}
+
+// Required reports whether the i'th argument has to be given.
+func (command *Command) Required(i int) bool {
+	return i < command.minArgs
+}
+
+// Fits reports whether n arguments are enough for the command, and not too
+// many.
+func (command *Command) Fits(n int) bool {
+	return n >= command.minArgs && n <= command.maxArgs
+}
+
+// Usage shows how to run the command, e.g. ".faves [user]".
+func (command *Command) Usage(prefix string) string {
+	usage := prefix + command.command
+	for i, arg := range command.Args() {
+		name := arg.Name
+		if arg.Rest {
+			name += "..."
+		}
+		if command.Required(i) {
+			usage += " <" + name + ">"
+		} else {
+			usage += " [" + name + "]"
+		}
+	}
+	return usage
+}
@@ -0,0 +1,45 @@
+package commands
+
+import "strings"
+
+// Channel is a snapshot of a channel's state, as tracked by a CommandContext.
+type Channel struct {
+	Name    string
+	Topic   string
+	Members []Member
+	// The bot's own privileges in the channel.
+	Me Privileges
+}
+
+type Member struct {
+	User
+	Privileges
+}
+
+// Privileges are a member's channel modes. Platforms without an equivalent
+// for a mode map their own permissions onto the closest one, e.g. Discord's
+// channel managers count as ops.
+type Privileges struct {
+	Owner, Admin, Op, HalfOp, Voice bool
+}
+
+// Operator reports whether these privileges include op or anything above it.
+func (p Privileges) Operator() bool {
+	return p.Owner || p.Admin || p.Op
+}
+
+// Voiced reports whether these privileges let a member speak in a moderated
+// channel.
+func (p Privileges) Voiced() bool {
+	return p.Operator() || p.HalfOp || p.Voice
+}
+
+// Member looks up a member of the channel by name, ignoring case.
+func (c *Channel) Member(name string) (*Member, bool) {
+	for i := range c.Members {
+		if strings.EqualFold(c.Members[i].Name, name) {
+			return &c.Members[i], true
+		}
+	}
+	return nil, false
+}
@@ -9,22 +9,54 @@ import (
 
 var (
 	commands      []*Command
+	hooks         []MessageHook
 	DefaultPrefix = "."
 )
 
+// A MessageHook sees every message before any command does.
+type MessageHook func(Message, CommandContext)
+
+// AddMessageHook registers a hook to run on every message, ahead of the
+// commands.
+func AddMessageHook(hook MessageHook) {
+	hooks = append(hooks, hook)
+}
+
+func runHooks(message Message, context CommandContext) {
+	for _, hook := range hooks {
+		hook(message, context)
+	}
+}
+
 type Command struct {
 	allowNoWhitespace bool
 	command           string
 	commandFunc       func(Message) string
+	description       string
 	function          ExecuteFunc
 	minArgs           int
 	maxArgs           int
+	args              []Arg
 	permission        *models.Permission
 	prefix            string
+	// Set when WithPrefix is used, so that a CommandSet's prefix doesn't
+	// override it.
+	customPrefix bool
+}
+
+func (command *Command) Name() string {
+	return command.command
 }
 
 func (command *Command) Execute(message Message, context CommandContext) {
-	prefix := command.prefix + command.command
+	command.execute(command.prefix, message, context)
+}
+
+func (command *Command) execute(prefix string, message Message, context CommandContext) {
+	if command.customPrefix {
+		prefix = command.prefix
+	}
+	prefix += command.command
 	if command.commandFunc != nil {
 		prefix = command.commandFunc(message)
 	}
@@ -35,22 +67,107 @@ func (command *Command) Execute(message Message, context CommandContext) {
 	if len(remainder) > 0 && !command.allowNoWhitespace && remainder[0] != '\t' && remainder[0] != ' ' {
 		return
 	}
-	args := parseArgs(remainder)
-	if len(args) > command.maxArgs || len(args) < command.minArgs {
-		return
+	command.Run(message, context, parseArgs(remainder)...)
+}
+
+// Run runs the command with arguments that have already been parsed, e.g.
+// from a Discord slash command. It returns false if the arguments don't fit
+// or the user isn't allowed to run it.
+func (command *Command) Run(message Message, context CommandContext, args ...string) bool {
+	if !command.Fits(len(args)) {
+		return false
 	}
 	if command.permission != nil && !context.Authorize(message.Source, *command.permission) {
-		return
+		return false
 	}
 	context.Execute(command.function, message, args...)
+	return true
+}
+
+// Matched reports whether the command is triggered by plain "prefix+name"
+// text, rather than a custom WithCommandFunc.
+func (command *Command) Matched() bool {
+	return command.commandFunc == nil
+}
+
+func (command *Command) Description() string {
+	if command.description == "" {
+		return "Runs " + DefaultPrefix + command.command
+	}
+	return command.description
 }
 
 func ExecuteCommands(message Message, context CommandContext) {
+	runHooks(message, context)
 	for _, command := range commands {
 		command.Execute(message, context)
 	}
 }
 
+// A CommandSet restricts the registered commands to a subset and swaps in a
+// different prefix, so e.g. each IRC network can have its own command
+// configuration.
+type CommandSet struct {
+	prefix  string
+	enabled map[string]bool
+}
+
+// NewCommandSet creates a CommandSet with the given prefix. If prefix is empty
+// DefaultPrefix is used, and if enabled is empty every command is enabled.
+func NewCommandSet(prefix string, enabled []string) *CommandSet {
+	set := &CommandSet{
+		prefix: prefix,
+	}
+	if set.prefix == "" {
+		set.prefix = DefaultPrefix
+	}
+	if len(enabled) > 0 {
+		set.enabled = make(map[string]bool)
+		for _, name := range enabled {
+			set.enabled[name] = true
+		}
+	}
+	return set
+}
+
+func (set *CommandSet) Prefix() string {
+	return set.prefix
+}
+
+func (set *CommandSet) Enabled(command *Command) bool {
+	return set.enabled == nil || set.enabled[command.command]
+}
+
+// Commands returns the commands enabled in the set.
+func (set *CommandSet) Commands() []*Command {
+	var enabled []*Command
+	for _, command := range commands {
+		if set.Enabled(command) {
+			enabled = append(enabled, command)
+		}
+	}
+	return enabled
+}
+
+// Lookup finds an enabled command by name.
+func (set *CommandSet) Lookup(name string) (*Command, bool) {
+	for _, command := range commands {
+		if command.command == name && set.Enabled(command) {
+			return command, true
+		}
+	}
+	return nil, false
+}
+
+func (set *CommandSet) ExecuteCommands(message Message, context CommandContext) {
+	runHooks(message, context)
+	for _, command := range commands {
+		if set.Enabled(command) {
+			command.execute(set.prefix, message, context)
+		}
+	}
+}
+
 func parseArgs(argstring string) []string {
 	var args []string
 	inQuotes := false
@@ -140,6 +257,11 @@ type User struct {
 	Id          *int
 	Name        string
 	DisplayName string
+	// The platform's own identifier for the user, where nicknames aren't
+	// enough, e.g. a Discord user ID.
+	PlatformID string
+	// The Eden username, if the platform has already told us who this is.
+	Account string
 }
 
 func WithArgs(numArgs int) commandOption {
@@ -175,6 +297,14 @@ func WithPermissionCheck(permission models.Permission) commandOption {
 func WithPrefix(prefix string) commandOption {
 	return func(c *Command) error {
 		c.prefix = prefix
+		c.customPrefix = true
+		return nil
+	}
+}
+
+func WithDescription(description string) commandOption {
+	return func(c *Command) error {
+		c.description = description
 		return nil
 	}
 }
@@ -189,6 +319,14 @@ func WithCommandFunc(commandFunc func(Message) string) commandOption {
 type CommandContext interface {
 	Execute(ExecuteFunc, Message, ...string)
 	Authorize(User, models.Permission) bool
+	// Identify returns the Eden user behind a platform user, if they've
+	// proven who they are.
+	Identify(User) (*models.User, bool)
 	SendToUser(User, string)
 	SendToChannel(string, string)
+	// Channel returns the current state of a channel the bot is in.
+	Channel(string) (*Channel, bool)
+	// Prefix is what commands start with here, for telling people how to
+	// run them.
+	Prefix() string
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+)
+
+// Connection is anything the bot connects to and takes commands from, i.e. an
+// IRC network or Discord.
+type Connection interface {
+	// Name uniquely identifies the connection within a ConnectionManager.
+	Name() string
+	Start() error
+	// Stop disconnects gracefully. The returned channel is closed once the
+	// connection has been torn down.
+	Stop() <-chan struct{}
+	Status() ConnectionStatus
+	CommandContext() commands.CommandContext
+}
+
+type ConnectionStatus int
+
+const (
+	StatusStopped ConnectionStatus = iota
+	StatusConnecting
+	StatusConnected
+	StatusDisconnected
+)
+
+func (s ConnectionStatus) String() string {
+	switch s {
+	case StatusStopped:
+		return "stopped"
+	case StatusConnecting:
+		return "connecting"
+	case StatusConnected:
+		return "connected"
+	case StatusDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("ConnectionStatus(%d)", int(s))
+}
+
+// connectionStatus is a ConnectionStatus that's safe to share between
+// goroutines, for embedding in Connection implementations.
+type connectionStatus struct {
+	status ConnectionStatus
+	mu     sync.RWMutex
+}
+
+func (s *connectionStatus) Status() ConnectionStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *connectionStatus) setStatus(status ConnectionStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+const (
+	supervisorInterval = 5 * time.Second
+	minRestartBackoff  = 5 * time.Second
+	maxRestartBackoff  = 5 * time.Minute
+	// How long a connection can spend connecting before we give up on it
+	// and start again, e.g. when the server never finishes registering us.
+	connectTimeout = 2 * time.Minute
+)
+
+// ConnectionManager owns the lifecycle of every Connection: it starts them,
+// restarts them when they drop, and stops them on shutdown.
+type ConnectionManager struct {
+	connections map[string]*managedConnection
+	mu          sync.Mutex
+}
+
+type managedConnection struct {
+	conn Connection
+	// Closing stop tells the supervisor to give up on the connection, and it
+	// closes done once it has.
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{
+		connections: make(map[string]*managedConnection),
+	}
+}
+
+// Add starts supervising conn, which will be started straight away.
+func (m *ConnectionManager) Add(conn Connection) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.connections[conn.Name()]; ok {
+		return fmt.Errorf("connection %s already exists", conn.Name())
+	}
+	mc := &managedConnection{
+		conn: conn,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	m.connections[conn.Name()] = mc
+	go m.supervise(mc)
+	return nil
+}
+
+// Remove stops the named connection and forgets about it. It waits at most
+// timeout for the connection to close.
+func (m *ConnectionManager) Remove(name string, timeout time.Duration) error {
+	m.mu.Lock()
+	mc, ok := m.connections[name]
+	delete(m.connections, name)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such connection %s", name)
+	}
+	if !stopManaged(mc, time.After(timeout)) {
+		return fmt.Errorf("timed out stopping %s", name)
+	}
+	return nil
+}
+
+func (m *ConnectionManager) Get(name string) (Connection, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mc, ok := m.connections[name]
+	if !ok {
+		return nil, false
+	}
+	return mc.conn, true
+}
+
+// Connections returns every managed connection, sorted by name.
+func (m *ConnectionManager) Connections() []Connection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conns := make([]Connection, len(names))
+	for i, name := range names {
+		conns[i] = m.connections[name].conn
+	}
+	return conns
+}
+
+// Shutdown stops every connection in parallel, giving up on any that haven't
+// closed by the time timeout has passed.
+func (m *ConnectionManager) Shutdown(timeout time.Duration) {
+	m.mu.Lock()
+	managed := m.connections
+	m.connections = make(map[string]*managedConnection)
+	m.mu.Unlock()
+
+	deadline := time.After(timeout)
+	var wait sync.WaitGroup
+	for name, mc := range managed {
+		wait.Add(1)
+		go func(name string, mc *managedConnection) {
+			defer wait.Done()
+			if !stopManaged(mc, deadline) {
+				log.Printf("Timed out stopping %s\n", name)
+			}
+		}(name, mc)
+	}
+	wait.Wait()
+}
+
+// stopManaged stops the supervisor and then the connection. It returns false
+// if deadline fires first.
+func stopManaged(mc *managedConnection, deadline <-chan time.Time) bool {
+	close(mc.stop)
+	<-mc.done
+	select {
+	case <-mc.conn.Stop():
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+func (m *ConnectionManager) supervise(mc *managedConnection) {
+	defer close(mc.done)
+	backoff := minRestartBackoff
+	// When we first saw the connection connecting, if it still is.
+	var connecting time.Time
+	for {
+		wait := supervisorInterval
+		status := mc.conn.Status()
+		if status != StatusConnecting {
+			connecting = time.Time{}
+		}
+		switch status {
+		case StatusConnected:
+			backoff = minRestartBackoff
+		case StatusConnecting:
+			if connecting.IsZero() {
+				connecting = time.Now()
+				break
+			}
+			if time.Since(connecting) < connectTimeout {
+				break
+			}
+			log.Printf("%s has been connecting for over %s, restarting it\n", mc.conn.Name(), connectTimeout)
+			connecting = time.Time{}
+			select {
+			case <-mc.conn.Stop():
+			case <-time.After(connectTimeout):
+				log.Printf("Timed out stopping %s\n", mc.conn.Name())
+			case <-mc.stop:
+				return
+			}
+			fallthrough
+		case StatusStopped, StatusDisconnected:
+			if err := mc.conn.Start(); err != nil {
+				log.Printf("Error starting %s, retrying in %s: %s\n", mc.conn.Name(), backoff, err)
+				wait = backoff
+				if backoff *= 2; backoff > maxRestartBackoff {
+					backoff = maxRestartBackoff
+				}
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-mc.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	defaultCTCPRate  = 0.2
+	defaultCTCPBurst = 3
+	// Once we're tracking this many sources, we start forgetting the ones
+	// that have calmed down.
+	maxCTCPSources = 256
+)
+
+// A CTCPHandler answers a CTCP query sent to us by nick. If it returns false
+// there's no reply.
+type CTCPHandler func(c *IrcConn, nick, arg string) (string, bool)
+
+var ctcpHandlers = make(map[string]CTCPHandler)
+
+// RegisterCTCP makes every IrcConn answer the given CTCP query. Like
+// commands, it's meant to be called from init.
+func RegisterCTCP(query string, handler CTCPHandler) {
+	ctcpHandlers[strings.ToUpper(query)] = handler
+}
+
+func init() {
+	RegisterCTCP("VERSION", func(c *IrcConn, nick, arg string) (string, bool) {
+		return c.cfg.Version, c.cfg.Version != ""
+	})
+	RegisterCTCP("PING", func(c *IrcConn, nick, arg string) (string, bool) {
+		return arg, true
+	})
+	RegisterCTCP("TIME", func(c *IrcConn, nick, arg string) (string, bool) {
+		return time.Now().Format(time.RFC1123Z), true
+	})
+	RegisterCTCP("SOURCE", func(c *IrcConn, nick, arg string) (string, bool) {
+		return config.SourceURL, config.SourceURL != ""
+	})
+	RegisterCTCP("CLIENTINFO", func(c *IrcConn, nick, arg string) (string, bool) {
+		return strings.Join(c.ctcpQueries(), " "), true
+	})
+}
+
+// answerCTCP replies to a CTCP query. ircSocket hands us the queries before
+// goirc sees them, so that goirc doesn't answer them too.
+func (c *IrcConn) answerCTCP(line *irc.Line) {
+	if len(line.Args) == 0 {
+		return
+	}
+	query := strings.ToUpper(line.Args[0])
+	arg := ""
+	if len(line.Args) > 2 {
+		arg = line.Args[2]
+	}
+	source := line.Host
+	if source == "" {
+		source = line.Nick
+	}
+	reply, ok := c.ctcpReply(query, line.Nick, arg)
+	if !ok || !c.ctcpLimiter.allow(source) {
+		return
+	}
+	if reply != "" {
+		reply = " " + reply
+	}
+	c.queue.push(priorityLow, fmt.Sprintf("%s %s :\001%s%s\001", irc.NOTICE, line.Nick, query, reply))
+}
+
+// ctcpReply answers a query from the configured replies if there's one, and
+// from the registered handlers if not. A reply configured as empty turns the
+// query off.
+func (c *IrcConn) ctcpReply(query, nick, arg string) (string, bool) {
+	c.settingsMu.RLock()
+	reply, configured := c.ctcpReplies[query]
+	c.settingsMu.RUnlock()
+	if configured {
+		return reply, reply != ""
+	}
+	if handler, ok := ctcpHandlers[query]; ok {
+		return handler(c, nick, arg)
+	}
+	return "", false
+}
+
+// ctcpReplyMap upper-cases the queries in the configured replies, since
+// that's how they come off the wire.
+func ctcpReplyMap(replies map[string]string) map[string]string {
+	m := make(map[string]string, len(replies))
+	for query, reply := range replies {
+		m[strings.ToUpper(query)] = reply
+	}
+	return m
+}
+
+// ctcpQueries lists the queries we answer, for CLIENTINFO.
+func (c *IrcConn) ctcpQueries() []string {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	var queries []string
+	for query := range ctcpHandlers {
+		if reply, ok := c.ctcpReplies[query]; !ok || reply != "" {
+			queries = append(queries, query)
+		}
+	}
+	for query, reply := range c.ctcpReplies {
+		if _, ok := ctcpHandlers[query]; !ok && reply != "" {
+			queries = append(queries, query)
+		}
+	}
+	sort.Strings(queries)
+	return queries
+}
+
+// ctcpLimiter gives each source its own token bucket, so one flooder can't
+// make us flood ourselves off the network.
+type ctcpLimiter struct {
+	rate    float64
+	burst   float64
+	sources map[string]*ctcpBucket
+	mu      sync.Mutex
+}
+
+type ctcpBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newCTCPLimiter(rate float64, burst int) *ctcpLimiter {
+	if rate <= 0 {
+		rate = defaultCTCPRate
+	}
+	if burst <= 0 {
+		burst = defaultCTCPBurst
+	}
+	return &ctcpLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		sources: make(map[string]*ctcpBucket),
+	}
+}
+
+func (l *ctcpLimiter) allow(source string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.sources) >= maxCTCPSources {
+		l.prune(now)
+	}
+	bucket, ok := l.sources[source]
+	if !ok {
+		bucket = &ctcpBucket{tokens: l.burst, last: now}
+		l.sources[source] = bucket
+	}
+	bucket.tokens = l.refill(bucket, now)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *ctcpLimiter) refill(bucket *ctcpBucket, now time.Time) float64 {
+	tokens := bucket.tokens + now.Sub(bucket.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// prune forgets sources whose buckets have filled back up, since a new
+// bucket would be just the same.
+func (l *ctcpLimiter) prune(now time.Time) {
+	for source, bucket := range l.sources {
+		if l.refill(bucket, now) >= l.burst {
+			delete(l.sources, source)
+		}
+	}
+}
@@ -2,12 +2,588 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/events"
+	"github.com/santiclause/eden/models"
 )
 
-func kek() {
-	discord, _ := discordgo.New(fmt.Sprintf("Bot %s", config.DiscordAuthToken))
-	discord.AddHandler(func(s *discordgo.Session, e *discordgo.MessageCreate) {
+// The longest message Discord will accept.
+const maxDiscordMessageLength = 2000
+
+type DiscordConn struct {
+	connectionStatus
+	session         *discordgo.Session
+	commandPrefix   string
+	enabledCommands []string
+	commands        *commands.CommandSet
+	// Guards commands, which can change on reload.
+	settingsMu sync.RWMutex
+	removers   []func()
+	// discordgo updates its state before our handlers run, so we keep our own
+	// copy of nicks and topics to spot what changed.
+	nicks    map[string]string
+	topics   map[string]string
+	changeMu sync.Mutex
+	// Discord role IDs or names to Eden role or permission names. Guarded by
+	// settingsMu.
+	roles map[string]string
+	// Eden permission names by Discord user ID, cached until something about
+	// the user changes.
+	permissions   map[string]map[string]bool
+	permissionsMu sync.Mutex
+	voiceSettings voiceSettings
+	voice         *voiceRelay
+	voiceMu       sync.Mutex
+	// Guarded by settingsMu.
+	topicSettings topicSettings
+	topicTemplate *template.Template
+	presence      *throttle
+	topic         *throttle
+	radioRemover  events.Remover
+	radioMu       sync.Mutex
+}
+
+// NewDiscordConn sets up a Discord bot session with the given options,
+// without connecting yet.
+func NewDiscordConn(token string, opts ...discordOption) (*DiscordConn, error) {
+	session, err := discordgo.New(fmt.Sprintf("Bot %s", token))
+	if err != nil {
+		return nil, err
+	}
+	// Members and message content are privileged, so they have to be
+	// turned on for the bot in the developer portal too.
+	session.Identify.Intents = discordgo.IntentsGuilds |
+		discordgo.IntentsGuildMessages |
+		discordgo.IntentsDirectMessages |
+		discordgo.IntentsGuildMembers |
+		discordgo.IntentsGuildVoiceStates |
+		discordgo.IntentsMessageContent
+	conn := &DiscordConn{
+		session:     session,
+		nicks:       make(map[string]string),
+		topics:      make(map[string]string),
+		permissions: make(map[string]map[string]bool),
+		presence:    &throttle{interval: presenceInterval},
+		topic:       &throttle{interval: minTopicInterval},
+	}
+	for _, opt := range opts {
+		if err := opt(conn); err != nil {
+			return nil, err
+		}
+	}
+	conn.commands = commands.NewCommandSet(conn.commandPrefix, conn.enabledCommands)
+	if conn.topicTemplate == nil {
+		if conn.topicTemplate, err = parseTopicTemplate(""); err != nil {
+			return nil, err
+		}
+	}
+	conn.removers = append(conn.removers,
+		session.AddHandler(conn.ready),
+		session.AddHandler(conn.disconnect),
+		session.AddHandler(conn.messageCreate),
+		session.AddHandler(conn.guildCreate),
+		session.AddHandler(conn.guildMemberAdd),
+		session.AddHandler(conn.guildMemberRemove),
+		session.AddHandler(conn.guildMemberUpdate),
+		session.AddHandler(conn.channelUpdate),
+		session.AddHandler(conn.interactionCreate),
+		session.AddHandler(conn.guildRoleDelete),
+	)
+	return conn, nil
+}
+
+// Connection interface methods
+
+func (c *DiscordConn) Name() string {
+	return "discord"
+}
+
+func (c *DiscordConn) Start() error {
+	c.setStatus(StatusConnecting)
+	if err := c.session.Open(); err != nil {
+		c.setStatus(StatusDisconnected)
+		return err
+	}
+	c.followRadio()
+	return nil
+}
+
+func (c *DiscordConn) Stop() <-chan struct{} {
+	done := make(chan struct{})
+	c.setStatus(StatusStopped)
+	c.unfollowRadio()
+	go func() {
+		c.stopVoice()
+		if err := c.session.Close(); err != nil {
+			log.Printf("Error closing Discord session: %s\n", err)
+		}
+		close(done)
+	}()
+	return done
+}
+
+func (c *DiscordConn) CommandContext() commands.CommandContext {
+	return c
+}
+
+// end interface definitions
+
+func (c *DiscordConn) ready(s *discordgo.Session, e *discordgo.Ready) {
+	c.setStatus(StatusConnected)
+	c.startVoice()
+	// Our presence doesn't survive reconnecting.
+	c.nowPlayingChanged()
+}
+
+func (c *DiscordConn) disconnect(s *discordgo.Session, e *discordgo.Disconnect) {
+	// discordgo reconnects by itself, so we're only really disconnected if
+	// we've been stopped.
+	if c.Status() != StatusStopped {
+		c.setStatus(StatusConnecting)
+	}
+}
+
+func (c *DiscordConn) messageCreate(s *discordgo.Session, e *discordgo.MessageCreate) {
+	if e.Author == nil || e.Author.ID == s.State.User.ID || e.Author.Bot {
+		return
+	}
+	channel, err := s.State.Channel(e.ChannelID)
+	if err != nil {
+		if channel, err = s.Channel(e.ChannelID); err != nil {
+			log.Printf("Error fetching Discord channel %s: %s\n", e.ChannelID, err)
+			return
+		}
+	}
+	message := commands.Message{
+		Content: e.Content,
+		Public:  channel.GuildID != "",
+		Source: commands.User{
+			Name:       e.Author.Username,
+			PlatformID: e.Author.ID,
+		},
+		Target: e.ChannelID,
+	}
+	source := c.source("")
+	if message.Public {
+		source.Channel = e.ChannelID
+	}
+	events.Publish(events.MessageReceived{
+		Source:  source,
+		Message: message,
+	})
+	c.commandSet().ExecuteCommands(message, c)
+}
+
+// source is the events.Source for events in the given channel ID, which may
+// be empty.
+func (c *DiscordConn) source(channelID string) events.Source {
+	return events.Source{
+		Connection: c.Name(),
+		Context:    c,
+		Channel:    channelID,
+		Time:       time.Now(),
+	}
+}
+
+func discordUser(member *discordgo.Member) commands.User {
+	return commands.User{
+		Name:        member.User.Username,
+		DisplayName: member.Nick,
+		PlatformID:  member.User.ID,
+	}
+}
+
+func (c *DiscordConn) guildCreate(s *discordgo.Session, e *discordgo.GuildCreate) {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	for _, member := range e.Members {
+		c.nicks[e.ID+member.User.ID] = member.Nick
+	}
+	for _, channel := range e.Channels {
+		c.topics[channel.ID] = channel.Topic
+	}
+	go c.registerSlashCommands(e.ID)
+}
+
+func (c *DiscordConn) guildMemberAdd(s *discordgo.Session, e *discordgo.GuildMemberAdd) {
+	c.changeMu.Lock()
+	c.nicks[e.GuildID+e.User.ID] = e.Nick
+	c.changeMu.Unlock()
+	events.Publish(events.UserJoined{
+		Source: c.source(""),
+		User:   discordUser(e.Member),
+	})
+}
+
+func (c *DiscordConn) guildMemberRemove(s *discordgo.Session, e *discordgo.GuildMemberRemove) {
+	c.forgetPermissions(e.User.ID)
+	c.changeMu.Lock()
+	delete(c.nicks, e.GuildID+e.User.ID)
+	c.changeMu.Unlock()
+	events.Publish(events.UserLeft{
+		Source: c.source(""),
+		User:   discordUser(e.Member),
+	})
+}
+
+func (c *DiscordConn) guildMemberUpdate(s *discordgo.Session, e *discordgo.GuildMemberUpdate) {
+	// Their roles might have changed.
+	c.forgetPermissions(e.User.ID)
+	c.changeMu.Lock()
+	old, ok := c.nicks[e.GuildID+e.User.ID]
+	c.nicks[e.GuildID+e.User.ID] = e.Nick
+	c.changeMu.Unlock()
+	if !ok || old == e.Nick {
+		return
+	}
+	oldUser := discordUser(e.Member)
+	oldUser.DisplayName = old
+	events.Publish(events.NickChanged{
+		Source: c.source(""),
+		Old:    oldUser,
+		New:    discordUser(e.Member),
+	})
+}
+
+func (c *DiscordConn) channelUpdate(s *discordgo.Session, e *discordgo.ChannelUpdate) {
+	c.changeMu.Lock()
+	old, ok := c.topics[e.ID]
+	c.topics[e.ID] = e.Topic
+	c.changeMu.Unlock()
+	if !ok || old == e.Topic {
+		return
+	}
+	// Discord doesn't tell us who changed the topic.
+	events.Publish(events.TopicChanged{
+		Source: c.source(e.ID),
+		Topic:  e.Topic,
 	})
 }
+
+// A role going away can change anyone's permissions. Renaming one can't,
+// since we only go by ID.
+func (c *DiscordConn) guildRoleDelete(s *discordgo.Session, e *discordgo.GuildRoleDelete) {
+	c.forgetPermissions("")
+}
+
+// startVoice starts relaying the radio to the voice channel, if there is one
+// and we aren't already.
+func (c *DiscordConn) startVoice() {
+	c.voiceMu.Lock()
+	defer c.voiceMu.Unlock()
+	c.startVoiceLocked()
+}
+
+func (c *DiscordConn) startVoiceLocked() {
+	if c.voice == nil && c.voiceSettings.Channel != "" && c.voiceSettings.Source != "" {
+		c.voice = startVoiceRelay(c, c.voiceSettings)
+	}
+}
+
+func (c *DiscordConn) stopVoice() {
+	c.voiceMu.Lock()
+	defer c.voiceMu.Unlock()
+	c.stopVoiceLocked()
+}
+
+func (c *DiscordConn) stopVoiceLocked() {
+	if c.voice != nil {
+		c.voice.Stop()
+		c.voice = nil
+	}
+}
+
+// setVoiceSettings restarts the relay with new settings if they've changed.
+// It holds voiceMu throughout, so that ready can't start a relay with the
+// old ones halfway through.
+func (c *DiscordConn) setVoiceSettings(settings voiceSettings) {
+	c.voiceMu.Lock()
+	defer c.voiceMu.Unlock()
+	if c.voiceSettings == settings {
+		return
+	}
+	c.stopVoiceLocked()
+	c.voiceSettings = settings
+	if c.Status() == StatusConnected {
+		c.startVoiceLocked()
+	}
+}
+
+func (c *DiscordConn) commandSet() *commands.CommandSet {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return c.commands
+}
+
+// CommandContext interface methods
+
+func (c *DiscordConn) Execute(f commands.ExecuteFunc, message commands.Message, args ...string) {
+	f(c, message, args...)
+}
+
+// Authorize checks the permissions of the user's linked Eden account, and of
+// the Eden roles their Discord roles map to.
+func (c *DiscordConn) Authorize(userInfo commands.User, permission models.Permission) bool {
+	if userInfo.PlatformID == "" {
+		return false
+	}
+	c.permissionsMu.Lock()
+	permissions, ok := c.permissions[userInfo.PlatformID]
+	c.permissionsMu.Unlock()
+	if !ok {
+		permissions = c.lookupPermissions(userInfo)
+		c.permissionsMu.Lock()
+		c.permissions[userInfo.PlatformID] = permissions
+		c.permissionsMu.Unlock()
+	}
+	return permissions[permission.Name]
+}
+
+// Identify trusts Discord about who's who, so all it takes is a row in
+// discordUsers.
+func (c *DiscordConn) Identify(userInfo commands.User) (*models.User, bool) {
+	discordUser := models.DiscordUser{
+		DiscordID: userInfo.PlatformID,
+	}
+	if userInfo.PlatformID == "" || db.Where(&discordUser).First(&discordUser).RecordNotFound() {
+		return nil, false
+	}
+	user := new(models.User)
+	if err := db.Model(&discordUser).Related(user).Error; err != nil {
+		log.Printf("Error fetching user for discordUser: %s\n", err)
+		return nil, false
+	}
+	return user, true
+}
+
+func (c *DiscordConn) SendToUser(userInfo commands.User, message string) {
+	channel, err := c.session.UserChannelCreate(userInfo.PlatformID)
+	if err != nil {
+		log.Printf("Error opening DM with %s: %s\n", userInfo.Name, err)
+		return
+	}
+	c.SendToChannel(channel.ID, message)
+}
+
+func (c *DiscordConn) SendToChannel(channel, message string) {
+	for _, chunk := range splitMessage(message, maxDiscordMessageLength) {
+		if _, err := c.session.ChannelMessageSend(channel, chunk); err != nil {
+			log.Printf("Error sending to Discord channel %s: %s\n", channel, err)
+			return
+		}
+	}
+}
+
+// Channel takes a channel ID. Its members are the guild members that can read
+// the channel, as far as our cached state knows.
+func (c *DiscordConn) Channel(channelID string) (*commands.Channel, bool) {
+	state := c.session.State
+	ch, err := state.Channel(channelID)
+	if err != nil || ch.GuildID == "" {
+		return nil, false
+	}
+	guild, err := state.Guild(ch.GuildID)
+	if err != nil {
+		return nil, false
+	}
+	channel := &commands.Channel{
+		Name:  ch.Name,
+		Topic: ch.Topic,
+		Me:    c.privileges(guild, state.User.ID, channelID),
+	}
+	for _, member := range guild.Members {
+		perms, err := state.UserChannelPermissions(member.User.ID, channelID)
+		if err != nil || perms&discordgo.PermissionReadMessages == 0 {
+			continue
+		}
+		channel.Members = append(channel.Members, commands.Member{
+			User:       discordUser(member),
+			Privileges: c.privileges(guild, member.User.ID, channelID),
+		})
+	}
+	return channel, true
+}
+
+func (c *DiscordConn) Prefix() string {
+	return c.commandSet().Prefix()
+}
+
+// end interface definitions
+
+// linker interface methods
+
+func (c *DiscordConn) platformIdentity(userInfo commands.User) platformIdentity {
+	return platformIdentity{
+		Platform: "discord",
+		Identity: userInfo.PlatformID,
+		Name:     userInfo.Name,
+	}
+}
+
+// Discord has already vouched for who the user is.
+func (c *DiscordConn) verifyIdentity(userInfo commands.User) bool {
+	return userInfo.PlatformID != ""
+}
+
+// end interface definitions
+
+func (c *DiscordConn) lookupPermissions(userInfo commands.User) map[string]bool {
+	permissions := make(map[string]bool)
+	if user, ok := c.Identify(userInfo); ok {
+		if err := user.GetPermissions(db); err != nil {
+			log.Printf("Error fetching user permissions: %s\n", err)
+		}
+		for _, p := range user.Permissions {
+			permissions[p.Name] = true
+		}
+	}
+	if names := c.mappedRoles(userInfo.PlatformID); len(names) > 0 {
+		granted, err := models.PermissionsByName(db, names)
+		if err != nil {
+			log.Printf("Error fetching permissions for Discord roles: %s\n", err)
+		}
+		for _, p := range granted {
+			permissions[p.Name] = true
+		}
+	}
+	return permissions
+}
+
+// mappedRoles gives the Eden role and permission names that the user's roles
+// in our guilds map to. Roles only go by ID: anyone running a guild we're in
+// can give a role whatever name they like.
+func (c *DiscordConn) mappedRoles(userID string) []string {
+	c.settingsMu.RLock()
+	roles := c.roles
+	c.settingsMu.RUnlock()
+	if len(roles) == 0 {
+		return nil
+	}
+	var names []string
+	for _, guildID := range c.guildIDs() {
+		member, err := c.session.State.Member(guildID, userID)
+		if err != nil {
+			if member, err = c.session.GuildMember(guildID, userID); err != nil {
+				// They're not in this guild.
+				continue
+			}
+		}
+		for _, roleID := range member.Roles {
+			if name, ok := roles[roleID]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (c *DiscordConn) guildIDs() []string {
+	state := c.session.State
+	state.RLock()
+	defer state.RUnlock()
+	ids := make([]string, len(state.Guilds))
+	for i, guild := range state.Guilds {
+		ids[i] = guild.ID
+	}
+	return ids
+}
+
+// forgetPermissions drops the cached permissions for a user, or for everyone
+// if userID is empty.
+func (c *DiscordConn) forgetPermissions(userID string) {
+	c.permissionsMu.Lock()
+	defer c.permissionsMu.Unlock()
+	if userID == "" {
+		c.permissions = make(map[string]map[string]bool)
+	} else {
+		delete(c.permissions, userID)
+	}
+}
+
+// privileges maps a member's Discord permissions in a channel onto IRC-style
+// channel modes.
+func (c *DiscordConn) privileges(guild *discordgo.Guild, userID, channelID string) commands.Privileges {
+	perms, err := c.session.State.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		return commands.Privileges{}
+	}
+	return commands.Privileges{
+		Owner:  guild.OwnerID == userID,
+		Admin:  perms&discordgo.PermissionAdministrator != 0,
+		Op:     perms&discordgo.PermissionManageChannels != 0,
+		HalfOp: perms&discordgo.PermissionManageMessages != 0,
+		Voice:  perms&discordgo.PermissionSendMessages != 0,
+	}
+}
+
+type discordOption func(*DiscordConn) error
+
+func WithDiscordCommandPrefix(prefix string) discordOption {
+	return func(c *DiscordConn) error {
+		c.commandPrefix = prefix
+		return nil
+	}
+}
+
+// WithDiscordRoles maps Discord role IDs to the Eden roles or
+// permissions they grant.
+func WithDiscordRoles(roles map[string]string) discordOption {
+	return func(c *DiscordConn) error {
+		c.roles = copyRoles(roles)
+		return nil
+	}
+}
+
+// copyRoles copies a role map, so that the connection's roles don't change
+// under it when the config is reloaded.
+func copyRoles(roles map[string]string) map[string]string {
+	if roles == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(roles))
+	for k, v := range roles {
+		copied[k] = v
+	}
+	return copied
+}
+
+func WithDiscordVoice(settings voiceSettings) discordOption {
+	return func(c *DiscordConn) error {
+		if settings.WhenAlone != "" && settings.WhenAlone != "pause" && settings.WhenAlone != "leave" {
+			return fmt.Errorf("unknown discord_voice_when_alone %q, want pause or leave", settings.WhenAlone)
+		}
+		c.voiceSettings = settings
+		return nil
+	}
+}
+
+// WithDiscordTopic keeps a channel's topic up to date with the radio. The
+// template gets the NowPlaying.
+func WithDiscordTopic(settings topicSettings) discordOption {
+	return func(c *DiscordConn) error {
+		tmpl, err := parseTopicTemplate(settings.Template)
+		if err != nil {
+			return err
+		}
+		if settings.Interval < minTopicInterval {
+			settings.Interval = minTopicInterval
+		}
+		c.topicSettings = settings
+		c.topicTemplate = tmpl
+		c.topic = &throttle{interval: settings.Interval}
+		return nil
+	}
+}
+
+func WithDiscordEnabledCommands(names []string) discordOption {
+	return func(c *DiscordConn) error {
+		c.enabledCommands = names
+		return nil
+	}
+}
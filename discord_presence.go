@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/santiclause/eden/events"
+)
+
+const (
+	// Discord only lets us set our presence every few seconds.
+	presenceInterval = 15 * time.Second
+	// and a channel's topic twice every ten minutes.
+	minTopicInterval = 5 * time.Minute
+	// The longest topic Discord will accept.
+	maxDiscordTopicLength = 1024
+
+	defaultTopicTemplate = "Now playing: {{.}}{{if .DJ}} | DJ: {{.DJ}}{{end}}"
+)
+
+// topicSettings says which Discord channel's topic follows the radio, and
+// what it says.
+type topicSettings struct {
+	Channel  string
+	Template string
+	Interval time.Duration
+}
+
+// throttle runs the latest function it's given at most once per interval.
+// Anything superseded while it's waiting is dropped, since we only care about
+// what's playing now.
+type throttle struct {
+	interval time.Duration
+	last     time.Time
+	pending  func()
+	timer    *time.Timer
+	mu       sync.Mutex
+}
+
+func (t *throttle) do(f func()) {
+	t.mu.Lock()
+	if t.timer != nil {
+		t.pending = f
+		t.mu.Unlock()
+		return
+	}
+	wait := t.interval - time.Since(t.last)
+	if wait <= 0 {
+		t.last = time.Now()
+		t.mu.Unlock()
+		f()
+		return
+	}
+	t.pending = f
+	t.timer = time.AfterFunc(wait, t.fire)
+	t.mu.Unlock()
+}
+
+func (t *throttle) fire() {
+	t.mu.Lock()
+	f := t.pending
+	t.pending, t.timer = nil, nil
+	t.last = time.Now()
+	t.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// setInterval changes the interval from the next run on.
+func (t *throttle) setInterval(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.interval = interval
+}
+
+// stop drops anything that's waiting to run.
+func (t *throttle) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.pending, t.timer = nil, nil
+	}
+}
+
+// followRadio keeps our presence, and the topic channel if there is one, up
+// to date with the radio.
+func (c *DiscordConn) followRadio() {
+	c.radioMu.Lock()
+	defer c.radioMu.Unlock()
+	if c.radioRemover == nil {
+		c.radioRemover = events.Subscribe(func(events.Event) {
+			c.nowPlayingChanged()
+		}, events.OfType(events.SongChangedEvent, events.DJChangedEvent))
+	}
+}
+
+func (c *DiscordConn) unfollowRadio() {
+	c.radioMu.Lock()
+	defer c.radioMu.Unlock()
+	if c.radioRemover != nil {
+		c.radioRemover.Remove()
+		c.radioRemover = nil
+	}
+	c.presence.stop()
+	c.topic.stop()
+}
+
+func (c *DiscordConn) nowPlayingChanged() {
+	if c.Status() != StatusConnected {
+		return
+	}
+	c.presence.do(c.updatePresence)
+	c.settingsMu.RLock()
+	channel := c.topicSettings.Channel
+	c.settingsMu.RUnlock()
+	if channel != "" {
+		c.topic.do(c.updateTopic)
+	}
+}
+
+func (c *DiscordConn) updatePresence() {
+	np := CurrentlyPlaying()
+	if err := c.session.UpdateListeningStatus(np.String()); err != nil {
+		log.Printf("Error updating Discord presence: %s\n", err)
+	}
+}
+
+func (c *DiscordConn) updateTopic() {
+	c.settingsMu.RLock()
+	channel, tmpl := c.topicSettings.Channel, c.topicTemplate
+	c.settingsMu.RUnlock()
+	if channel == "" || tmpl == nil {
+		return
+	}
+	var topic bytes.Buffer
+	if err := tmpl.Execute(&topic, CurrentlyPlaying()); err != nil {
+		log.Printf("Error rendering Discord topic: %s\n", err)
+		return
+	}
+	text := truncate(topic.String(), maxDiscordTopicLength)
+	// Don't waste an edit if it wouldn't change anything.
+	if ch, err := c.session.State.Channel(channel); err == nil && ch.Topic == text {
+		return
+	}
+	data := struct {
+		Topic string `json:"topic"`
+	}{text}
+	url := discordgo.EndpointChannel(channel)
+	if _, err := c.session.RequestWithBucketID("PATCH", url, data, url); err != nil {
+		log.Printf("Error setting Discord topic: %s\n", err)
+	}
+}
+
+func parseTopicTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultTopicTemplate
+	}
+	return template.New("topic").Parse(text)
+}
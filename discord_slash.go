@@ -0,0 +1,337 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/santiclause/eden/commands"
+)
+
+const (
+	// Discord gives us three seconds to respond to an interaction, so if a
+	// command hasn't said anything by this point we tell Discord to wait.
+	interactionDeferAfter = 2 * time.Second
+	maxSlashOptions       = 25
+	maxSlashDescription   = 100
+)
+
+var slashCommandName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// slashCommands turns the enabled commands into Discord's idea of them.
+// Commands that match their own way, or that Discord wouldn't accept the name
+// of, are left out.
+func (c *DiscordConn) slashCommands() []*discordgo.ApplicationCommand {
+	slash := []*discordgo.ApplicationCommand{}
+	for _, command := range c.commandSet().Commands() {
+		if !command.Matched() || !slashCommandName.MatchString(command.Name()) {
+			continue
+		}
+		sc := &discordgo.ApplicationCommand{
+			Name:        command.Name(),
+			Description: truncate(command.Description(), maxSlashDescription),
+		}
+		for i, arg := range command.Args() {
+			if i == maxSlashOptions {
+				break
+			}
+			description := arg.Description
+			if description == "" {
+				description = arg.Name
+			}
+			sc.Options = append(sc.Options, &discordgo.ApplicationCommandOption{
+				Type:        slashOptionType(arg.Type),
+				Name:        strings.ToLower(arg.Name),
+				Description: truncate(description, maxSlashDescription),
+				Required:    command.Required(i),
+			})
+		}
+		slash = append(slash, sc)
+	}
+	return slash
+}
+
+func slashOptionType(t commands.ArgType) discordgo.ApplicationCommandOptionType {
+	switch t {
+	case commands.ArgInteger:
+		return discordgo.ApplicationCommandOptionInteger
+	case commands.ArgBoolean:
+		return discordgo.ApplicationCommandOptionBoolean
+	case commands.ArgUser:
+		return discordgo.ApplicationCommandOptionUser
+	}
+	return discordgo.ApplicationCommandOptionString
+}
+
+// truncate cuts s down to max characters.
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+// slashSignature is the part of a slash command we set, for telling whether
+// Discord's copy is out of date. Discord fills in plenty more.
+type slashSignature struct {
+	Name        string
+	Description string
+	Options     []slashOptionSignature
+}
+
+type slashOptionSignature struct {
+	Type        discordgo.ApplicationCommandOptionType
+	Name        string
+	Description string
+	Required    bool
+}
+
+func slashSignatures(commands []*discordgo.ApplicationCommand) map[string]slashSignature {
+	signatures := make(map[string]slashSignature)
+	for _, command := range commands {
+		signature := slashSignature{
+			Name:        command.Name,
+			Description: command.Description,
+		}
+		for _, option := range command.Options {
+			signature.Options = append(signature.Options, slashOptionSignature{
+				Type:        option.Type,
+				Name:        option.Name,
+				Description: option.Description,
+				Required:    option.Required,
+			})
+		}
+		signatures[command.Name] = signature
+	}
+	return signatures
+}
+
+// registerSlashCommands makes the guild's slash commands match our commands.
+// It only writes to Discord if something has changed, so it's safe to call
+// every time we connect.
+func (c *DiscordConn) registerSlashCommands(guildID string) {
+	if c.session.State.User == nil {
+		return
+	}
+	appID := c.session.State.User.ID
+	want := c.slashCommands()
+	have, err := c.session.ApplicationCommands(appID, guildID)
+	if err != nil {
+		log.Printf("Error fetching slash commands for guild %s: %s\n", guildID, err)
+		return
+	}
+	if reflect.DeepEqual(slashSignatures(have), slashSignatures(want)) {
+		return
+	}
+	if _, err := c.session.ApplicationCommandBulkOverwrite(appID, guildID, want); err != nil {
+		log.Printf("Error registering slash commands for guild %s: %s\n", guildID, err)
+	}
+}
+
+// registerAllSlashCommands re-registers the slash commands in every guild
+// we're in, e.g. after the enabled commands have changed.
+func (c *DiscordConn) registerAllSlashCommands() {
+	if c.Status() != StatusConnected {
+		return
+	}
+	for _, guildID := range c.guildIDs() {
+		c.registerSlashCommands(guildID)
+	}
+}
+
+func (c *DiscordConn) interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type == discordgo.InteractionApplicationCommand {
+		c.runInteraction(i.Interaction)
+	}
+}
+
+func interactionUser(i *discordgo.Interaction) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+func (c *DiscordConn) runInteraction(i *discordgo.Interaction) {
+	user := interactionUser(i)
+	if user == nil {
+		return
+	}
+	ctx := &interactionContext{
+		DiscordConn: c,
+		interaction: i,
+	}
+	data := i.ApplicationCommandData()
+	command, ok := c.commandSet().Lookup(data.Name)
+	if !ok {
+		ctx.reply("That command isn't available here.", true)
+		return
+	}
+
+	// Options come back by name, so put them back in the command's order.
+	values := make(map[string]string)
+	for _, option := range data.Options {
+		values[option.Name] = optionValue(data, option)
+	}
+	var args []string
+	for _, arg := range command.Args() {
+		value, ok := values[strings.ToLower(arg.Name)]
+		if !ok {
+			break
+		}
+		args = append(args, value)
+	}
+	if !command.Fits(len(args)) {
+		ctx.reply("Usage: "+command.Usage("/"), true)
+		return
+	}
+	message := commands.Message{
+		Content: strings.TrimSpace(c.commandSet().Prefix() + command.Name() + " " + strings.Join(args, " ")),
+		Public:  i.GuildID != "",
+		Source: commands.User{
+			Name:       user.Username,
+			PlatformID: user.ID,
+		},
+		Target: i.ChannelID,
+	}
+	if i.Member != nil {
+		message.Source.DisplayName = i.Member.Nick
+	}
+
+	timer := time.AfterFunc(interactionDeferAfter, ctx.deferResponse)
+	ran := command.Run(message, ctx, args...)
+	timer.Stop()
+	if !ran {
+		ctx.reply("You can't do that.", true)
+	}
+	ctx.finish()
+}
+
+func optionValue(data discordgo.ApplicationCommandInteractionData, option *discordgo.ApplicationCommandInteractionDataOption) string {
+	switch option.Type {
+	case discordgo.ApplicationCommandOptionUser:
+		id := option.StringValue()
+		if data.Resolved != nil {
+			if user, ok := data.Resolved.Users[id]; ok {
+				return user.Username
+			}
+		}
+		return id
+	case discordgo.ApplicationCommandOptionInteger:
+		return strconv.FormatInt(option.IntValue(), 10)
+	case discordgo.ApplicationCommandOptionBoolean:
+		return strconv.FormatBool(option.BoolValue())
+	}
+	return option.StringValue()
+}
+
+// interactionContext answers a slash command through the interaction, and
+// otherwise behaves like the DiscordConn it came from.
+type interactionContext struct {
+	*DiscordConn
+	interaction *discordgo.Interaction
+	// Whether we've sent the initial response, and whether it was to tell
+	// Discord to wait.
+	responded bool
+	deferred  bool
+	mu        sync.Mutex
+}
+
+func (ctx *interactionContext) Execute(f commands.ExecuteFunc, message commands.Message, args ...string) {
+	f(ctx, message, args...)
+}
+
+// SendToUser replies to the person who ran the command with a message only
+// they can see.
+func (ctx *interactionContext) SendToUser(userInfo commands.User, message string) {
+	user := interactionUser(ctx.interaction)
+	if user == nil || user.ID != userInfo.PlatformID {
+		ctx.DiscordConn.SendToUser(userInfo, message)
+		return
+	}
+	ctx.reply(message, true)
+}
+
+func (ctx *interactionContext) SendToChannel(channel, message string) {
+	if channel != ctx.interaction.ChannelID {
+		ctx.DiscordConn.SendToChannel(channel, message)
+		return
+	}
+	ctx.reply(message, false)
+}
+
+func (ctx *interactionContext) reply(message string, ephemeral bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	var flags discordgo.MessageFlags
+	if ephemeral {
+		flags = discordgo.MessageFlagsEphemeral
+	}
+	for _, chunk := range splitMessage(message, maxDiscordMessageLength) {
+		var err error
+		switch {
+		case !ctx.responded:
+			err = ctx.session.InteractionRespond(ctx.interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: chunk,
+					Flags:   flags,
+				},
+			})
+			ctx.responded = true
+		case ctx.deferred && !ephemeral:
+			// Fill in the "thinking" message Discord is showing.
+			content := chunk
+			_, err = ctx.session.InteractionResponseEdit(ctx.interaction, &discordgo.WebhookEdit{Content: &content})
+			ctx.deferred = false
+		default:
+			_, err = ctx.session.FollowupMessageCreate(ctx.interaction, true, &discordgo.WebhookParams{
+				Content: chunk,
+				Flags:   flags,
+			})
+		}
+		if err != nil {
+			log.Printf("Error replying to interaction: %s\n", err)
+			return
+		}
+	}
+}
+
+// deferResponse tells Discord we're still working on it, if we haven't
+// replied yet.
+func (ctx *interactionContext) deferResponse() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.responded {
+		return
+	}
+	err := ctx.session.InteractionRespond(ctx.interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		log.Printf("Error deferring interaction: %s\n", err)
+	}
+	ctx.responded = true
+	ctx.deferred = true
+}
+
+// finish makes sure Discord doesn't show the interaction as failed or still
+// thinking once the command is done.
+func (ctx *interactionContext) finish() {
+	ctx.mu.Lock()
+	responded, deferred := ctx.responded, ctx.deferred
+	ctx.mu.Unlock()
+	if !responded {
+		ctx.reply("Done.", true)
+	} else if deferred {
+		if err := ctx.session.InteractionResponseDelete(ctx.interaction); err != nil {
+			log.Printf("Error tidying up interaction: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	voiceAloneCheckInterval = time.Second
+	voiceRetryInterval      = 10 * time.Second
+	// How long the voice connection can go without being ready before we
+	// give up on it and join again.
+	voiceReconnectAfter = 15 * time.Second
+	voiceSendTimeout    = time.Second
+)
+
+// voiceSettings says where to relay the radio on Discord.
+type voiceSettings struct {
+	Channel string
+	// An Ogg/Opus stream URL, or a file to play on repeat.
+	Source string
+	// "pause" keeps us in the channel when nobody's listening, "leave" leaves
+	// until someone turns up.
+	WhenAlone string
+}
+
+// voiceRelay plays the radio stream in a Discord voice channel. Discord wants
+// Opus, so the source has to be Ogg/Opus already; we only unwrap it.
+type voiceRelay struct {
+	conn     *DiscordConn
+	settings voiceSettings
+	playing  bool
+	mu       sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+	// Cancelling streaming stops the source from blocking, e.g. on a stream
+	// that's stalled.
+	streaming context.Context
+	cancel    context.CancelFunc
+	// How we get in and out of the voice channel, which the tests fake.
+	joinVoice  func(guildID string) (*discordgo.VoiceConnection, error)
+	leaveVoice func(vc *discordgo.VoiceConnection) error
+}
+
+func startVoiceRelay(conn *DiscordConn, settings voiceSettings) *voiceRelay {
+	r := newVoiceRelay(conn, settings)
+	go r.run()
+	return r
+}
+
+func newVoiceRelay(conn *DiscordConn, settings voiceSettings) *voiceRelay {
+	streaming, cancel := context.WithCancel(context.Background())
+	return &voiceRelay{
+		conn:      conn,
+		settings:  settings,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		streaming: streaming,
+		cancel:    cancel,
+		joinVoice: func(guildID string) (*discordgo.VoiceConnection, error) {
+			return conn.session.ChannelVoiceJoin(guildID, settings.Channel, false, true)
+		},
+		leaveVoice: (*discordgo.VoiceConnection).Disconnect,
+	}
+}
+
+// Stop leaves the voice channel and waits for the relay to finish.
+func (r *voiceRelay) Stop() {
+	r.cancel()
+	close(r.stop)
+	<-r.done
+}
+
+// wait sleeps for d, returning false if we're stopped in the meantime.
+func (r *voiceRelay) wait(d time.Duration) bool {
+	select {
+	case <-r.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (r *voiceRelay) run() {
+	defer close(r.done)
+	var (
+		vc        *discordgo.VoiceConnection
+		source    io.ReadCloser
+		packets   *oggReader
+		guildID   string
+		alone     bool
+		lastCheck time.Time
+		notReady  time.Time
+	)
+	closeSource := func() {
+		if source != nil {
+			source.Close()
+			source, packets = nil, nil
+		}
+		r.setPlaying(vc, false)
+	}
+	leave := func() {
+		closeSource()
+		if vc != nil {
+			if err := r.leaveVoice(vc); err != nil {
+				log.Printf("Error leaving Discord voice channel: %s\n", err)
+			}
+			vc = nil
+		}
+	}
+	defer leave()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		if guildID == "" {
+			var err error
+			if guildID, err = r.guildID(); err != nil {
+				log.Printf("Error finding Discord voice channel %s: %s\n", r.settings.Channel, err)
+				if !r.wait(voiceRetryInterval) {
+					return
+				}
+				continue
+			}
+		}
+		if time.Since(lastCheck) >= voiceAloneCheckInterval {
+			alone = r.alone(guildID)
+			lastCheck = time.Now()
+		}
+		if alone {
+			if r.settings.WhenAlone == "leave" {
+				leave()
+			} else {
+				closeSource()
+			}
+			if !r.wait(voiceAloneCheckInterval) {
+				return
+			}
+			continue
+		}
+
+		if vc == nil {
+			var err error
+			if vc, err = r.joinVoice(guildID); err != nil {
+				log.Printf("Error joining Discord voice channel %s: %s\n", r.settings.Channel, err)
+				vc = nil
+				if !r.wait(voiceRetryInterval) {
+					return
+				}
+				continue
+			}
+		}
+		// discordgo reconnects by itself when the voice server changes, but
+		// if that doesn't work out we start again from scratch.
+		vc.RLock()
+		ready := vc.Ready
+		vc.RUnlock()
+		if !ready {
+			if notReady.IsZero() {
+				notReady = time.Now()
+			} else if time.Since(notReady) > voiceReconnectAfter {
+				log.Printf("Discord voice connection hasn't come back, rejoining\n")
+				leave()
+				notReady = time.Time{}
+			}
+			if !r.wait(100 * time.Millisecond) {
+				return
+			}
+			continue
+		}
+		notReady = time.Time{}
+
+		if packets == nil {
+			var err error
+			if source, err = openVoiceSource(r.streaming, r.settings.Source); err != nil {
+				log.Printf("Error opening voice source %s: %s\n", r.settings.Source, err)
+				if !r.wait(voiceRetryInterval) {
+					return
+				}
+				continue
+			}
+			packets = newOggReader(source)
+			r.setPlaying(vc, true)
+		}
+		packet, err := packets.ReadPacket()
+		if err != nil {
+			closeSource()
+			// Files just start again from the top, but a stream that's
+			// dropped probably needs a moment.
+			if err != io.EOF || isStreamURL(r.settings.Source) {
+				log.Printf("Error reading voice source %s: %s\n", r.settings.Source, err)
+				if !r.wait(voiceRetryInterval) {
+					return
+				}
+			}
+			continue
+		}
+		// discordgo sends a packet every 20ms, which paces us.
+		select {
+		case vc.OpusSend <- packet:
+		case <-time.After(voiceSendTimeout):
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *voiceRelay) guildID() (string, error) {
+	channel, err := r.conn.session.State.Channel(r.settings.Channel)
+	if err != nil {
+		if channel, err = r.conn.session.Channel(r.settings.Channel); err != nil {
+			return "", err
+		}
+	}
+	if channel.GuildID == "" {
+		return "", fmt.Errorf("not a guild channel")
+	}
+	return channel.GuildID, nil
+}
+
+// alone reports whether there's nobody but bots in the voice channel.
+func (r *voiceRelay) alone(guildID string) bool {
+	state := r.conn.session.State
+	guild, err := state.Guild(guildID)
+	if err != nil {
+		return true
+	}
+	var userIDs []string
+	state.RLock()
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID == r.settings.Channel && vs.UserID != state.User.ID {
+			userIDs = append(userIDs, vs.UserID)
+		}
+	}
+	state.RUnlock()
+	for _, userID := range userIDs {
+		member, err := state.Member(guildID, userID)
+		if err != nil || member.User == nil || !member.User.Bot {
+			return false
+		}
+	}
+	return true
+}
+
+// setPlaying tells Discord whether we're sending audio.
+func (r *voiceRelay) setPlaying(vc *discordgo.VoiceConnection, playing bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.playing == playing {
+		return
+	}
+	r.playing = playing
+	if vc != nil {
+		if err := vc.Speaking(playing); err != nil {
+			log.Printf("Error setting Discord voice speaking: %s\n", err)
+		}
+	}
+}
+
+func isStreamURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// The stream never ends, so there's no timeout on the body. Cancelling the
+// request's context is what stops it.
+var voiceClient = &http.Client{}
+
+func openVoiceSource(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !isStreamURL(source) {
+		return os.Open(source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := voiceClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("stream returned %s", resp.Status)
+	}
+	return resp.Body, nil
+}
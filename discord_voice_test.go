@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// testVoiceRelay relays source to a fake voice connection in a guild where
+// the given users are in the voice channel.
+func testVoiceRelay(t *testing.T, source, whenAlone string, listeners ...*discordgo.User) (*voiceRelay, *discordgo.VoiceConnection, chan string) {
+	session, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.State.User = &discordgo.User{ID: "eden", Bot: true}
+	guild := &discordgo.Guild{
+		ID:       "guild",
+		Channels: []*discordgo.Channel{{ID: "voice", GuildID: "guild", Type: discordgo.ChannelTypeGuildVoice}},
+		Members:  []*discordgo.Member{},
+	}
+	for _, user := range listeners {
+		guild.VoiceStates = append(guild.VoiceStates, &discordgo.VoiceState{GuildID: "guild", ChannelID: "voice", UserID: user.ID})
+		guild.Members = append(guild.Members, &discordgo.Member{GuildID: "guild", User: user})
+	}
+	if err := session.State.GuildAdd(guild); err != nil {
+		t.Fatal(err)
+	}
+
+	vc := &discordgo.VoiceConnection{Ready: true, OpusSend: make(chan []byte)}
+	calls := make(chan string, 10)
+	r := newVoiceRelay(&DiscordConn{session: session}, voiceSettings{Channel: "voice", Source: source, WhenAlone: whenAlone})
+	r.joinVoice = func(guildID string) (*discordgo.VoiceConnection, error) {
+		calls <- "join " + guildID
+		return vc, nil
+	}
+	r.leaveVoice = func(*discordgo.VoiceConnection) error {
+		calls <- "leave"
+		return nil
+	}
+	return r, vc, calls
+}
+
+func TestVoiceRelayPlaysFileOnRepeat(t *testing.T) {
+	head := []byte("OpusHead\x01\x02\x00\x00\x80\xbb\x00\x00\x00\x00\x00")
+	source := filepath.Join(t.TempDir(), "radio.opus")
+	stream := concat(oggPage(0, head), oggPage(0, []byte("OpusTags")), oggPage(2880, []byte{1}, []byte{2}, []byte{3}))
+	if err := os.WriteFile(source, stream, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, vc, calls := testVoiceRelay(t, source, "pause", &discordgo.User{ID: "listener"})
+	go r.run()
+
+	var packets [][]byte
+	for len(packets) < 6 {
+		select {
+		case packet := <-vc.OpusSend:
+			packets = append(packets, packet)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %v", packets)
+		}
+	}
+	r.Stop()
+	want := [][]byte{{1}, {2}, {3}, {1}, {2}, {3}}
+	if !reflect.DeepEqual(packets, want) {
+		t.Errorf("packets = %v, want %v", packets, want)
+	}
+	close(calls)
+	var got []string
+	for call := range calls {
+		got = append(got, call)
+	}
+	if !reflect.DeepEqual(got, []string{"join guild", "leave"}) {
+		t.Errorf("calls = %v, want a join and a leave", got)
+	}
+}
+
+func TestVoiceRelayWaitsForListeners(t *testing.T) {
+	r, _, calls := testVoiceRelay(t, "unused.opus", "leave", &discordgo.User{ID: "other-bot", Bot: true})
+	go r.run()
+	time.Sleep(100 * time.Millisecond)
+	r.Stop()
+	select {
+	case call := <-calls:
+		t.Errorf("got %q with only bots listening", call)
+	default:
+	}
+}
+
+func TestVoiceRelayStopsOnStalledStream(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/ogg")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		requested <- struct{}{}
+		// Never send anything.
+		<-r.Context().Done()
+	}))
+	defer stream.Close()
+	r, _, _ := testVoiceRelay(t, stream.URL, "pause", &discordgo.User{ID: "listener"})
+	go r.run()
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay never opened the stream")
+	}
+	// Give it time to get stuck reading.
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		// Otherwise closing the server waits on the relay too.
+		stream.CloseClientConnections()
+		t.Fatal("Stop didn't return")
+	}
+}
@@ -0,0 +1,290 @@
+package events
+
+import (
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+)
+
+type EventType string
+
+const (
+	UserJoinedEvent       EventType = "UserJoined"
+	UserLeftEvent         EventType = "UserLeft"
+	NickChangedEvent      EventType = "NickChanged"
+	TopicChangedEvent     EventType = "TopicChanged"
+	MessageReceivedEvent  EventType = "MessageReceived"
+	SongChangedEvent      EventType = "SongChanged"
+	DJChangedEvent        EventType = "DJChanged"
+	ListenerPeakEvent     EventType = "ListenerPeak"
+	ListenersChangedEvent EventType = "ListenersChanged"
+	ThreadChangedEvent    EventType = "ThreadChanged"
+)
+
+type Event interface {
+	Type() EventType
+}
+
+// Source says where a platform event came from. Context can be used to reply.
+type Source struct {
+	// The name of the connection, e.g. "irc:rizon" or "discord".
+	Connection string
+	Context    commands.CommandContext
+	// Empty for events that aren't tied to a channel, like IRC quits.
+	Channel string
+	// When the connection saw it happen, since handlers may run a while
+	// later.
+	Time time.Time
+}
+
+type UserJoined struct {
+	Source
+	User commands.User
+}
+
+// UserLeft covers parts, quits and kicks.
+type UserLeft struct {
+	Source
+	User   commands.User
+	Reason string
+	// Set if the user was kicked, to whoever kicked them.
+	KickedBy *commands.User
+}
+
+type NickChanged struct {
+	Source
+	Old commands.User
+	New commands.User
+}
+
+type TopicChanged struct {
+	Source
+	User  commands.User
+	Topic string
+}
+
+type MessageReceived struct {
+	Source
+	Message commands.Message
+	// Set for IRC ACTIONs, i.e. /me.
+	Action bool
+	// Set for IRC NOTICEs.
+	Notice bool
+}
+
+type SongChanged struct {
+	Artist string
+	Title  string
+	// The song's ID in the songs table, or 0 if it isn't in the library.
+	SongID uint
+	Time   time.Time
+}
+
+type DJChanged struct {
+	DJ   string
+	Time time.Time
+}
+
+type ListenerPeak struct {
+	Listeners int
+	Time      time.Time
+}
+
+type ListenersChanged struct {
+	Listeners int
+	Time      time.Time
+}
+
+// ThreadChanged is the radio's discussion thread being set with .thread.
+type ThreadChanged struct {
+	Thread string
+	Time   time.Time
+}
+
+func (UserJoined) Type() EventType       { return UserJoinedEvent }
+func (UserLeft) Type() EventType         { return UserLeftEvent }
+func (NickChanged) Type() EventType      { return NickChangedEvent }
+func (TopicChanged) Type() EventType     { return TopicChangedEvent }
+func (MessageReceived) Type() EventType  { return MessageReceivedEvent }
+func (SongChanged) Type() EventType      { return SongChangedEvent }
+func (DJChanged) Type() EventType        { return DJChangedEvent }
+func (ListenerPeak) Type() EventType     { return ListenerPeakEvent }
+func (ListenersChanged) Type() EventType { return ListenersChangedEvent }
+func (ThreadChanged) Type() EventType    { return ThreadChangedEvent }
+
+// A Filter decides whether a subscriber gets an event.
+type Filter func(Event) bool
+
+// OfType matches events of any of the given types.
+func OfType(types ...EventType) Filter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type() == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// OnConnection matches platform events from the named connection.
+func OnConnection(name string) Filter {
+	return func(e Event) bool {
+		source, ok := sourceOf(e)
+		return ok && source.Connection == name
+	}
+}
+
+// InChannel matches platform events in the given channel, ignoring case.
+func InChannel(channel string) Filter {
+	return func(e Event) bool {
+		source, ok := sourceOf(e)
+		return ok && strings.EqualFold(source.Channel, channel)
+	}
+}
+
+func sourceOf(e Event) (Source, bool) {
+	switch e := e.(type) {
+	case UserJoined:
+		return e.Source, true
+	case UserLeft:
+		return e.Source, true
+	case NickChanged:
+		return e.Source, true
+	case TopicChanged:
+		return e.Source, true
+	case MessageReceived:
+		return e.Source, true
+	}
+	return Source{}, false
+}
+
+type Handler func(Event)
+
+// Removers allow a subscription to be cancelled again.
+type Remover interface {
+	Remove()
+}
+
+// A Bus delivers published events to every subscriber whose filters all
+// match. Handlers run in their own goroutines, so they don't hold up the
+// connection that published the event.
+type Bus struct {
+	subscribers map[*subscriber]struct{}
+	mu          sync.RWMutex
+}
+
+type subscriber struct {
+	bus     *Bus
+	handler Handler
+	filters []Filter
+	// Set for ordered subscribers, whose events are handled one at a time by
+	// a goroutine of their own.
+	queue chan Event
+}
+
+// How many events an ordered subscriber can fall behind by before Publish
+// waits for it.
+const orderedQueueSize = 1024
+
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+func (b *Bus) Subscribe(handler Handler, filters ...Filter) Remover {
+	s := &subscriber{
+		bus:     b,
+		handler: handler,
+		filters: filters,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// SubscribeOrdered is like Subscribe, but the handler gets events one at a
+// time, in the order they were published.
+func (b *Bus) SubscribeOrdered(handler Handler, filters ...Filter) Remover {
+	s := &subscriber{
+		bus:     b,
+		handler: handler,
+		filters: filters,
+		queue:   make(chan Event, orderedQueueSize),
+	}
+	go func() {
+		for e := range s.queue {
+			s.handle(e)
+		}
+	}()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+func (b *Bus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subscribers {
+		if !s.matches(e) {
+			continue
+		}
+		if s.queue != nil {
+			s.queue <- e
+		} else {
+			go s.handle(e)
+		}
+	}
+}
+
+func (s *subscriber) matches(e Event) bool {
+	for _, filter := range s.filters {
+		if !filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *subscriber) handle(e Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic handling %s event: %v\n%s", e.Type(), err, debug.Stack())
+		}
+	}()
+	s.handler(e)
+}
+
+func (s *subscriber) Remove() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subscribers[s]; ok && s.queue != nil {
+		// Nothing can be publishing to it while we hold the lock.
+		close(s.queue)
+	}
+	delete(s.bus.subscribers, s)
+}
+
+var defaultBus = NewBus()
+
+// Subscribe subscribes to the default bus.
+func Subscribe(handler Handler, filters ...Filter) Remover {
+	return defaultBus.Subscribe(handler, filters...)
+}
+
+// SubscribeOrdered subscribes to the default bus in order.
+func SubscribeOrdered(handler Handler, filters ...Filter) Remover {
+	return defaultBus.SubscribeOrdered(handler, filters...)
+}
+
+// Publish publishes to the default bus.
+func Publish(e Event) {
+	defaultBus.Publish(e)
+}
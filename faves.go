@@ -1,10 +1,205 @@
 package main
 
-import irc "github.com/fluffle/goirc/client"
+import (
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	// How many faves .faves lists before pointing at the website.
+	maxFavesListed = 10
+)
 
 func init() {
-	// addHook(irc.PRIVMSG, favesHook)
+	commands.NewCommand("fave", faveCommand,
+		commands.WithDescription("Add the song that's playing to your favourites"),
+	)
+	commands.NewCommand("unfave", unfaveCommand,
+		commands.WithDescription("Remove the song that's playing from your favourites"),
+	)
+	commands.NewCommand("faves", favesCommand,
+		commands.WithVarArgs(0, 1),
+		commands.WithDescription("List your favourites, or someone else's"),
+		commands.WithArgSpec(commands.Arg{Name: "user", Description: "Whose favourites to list", Type: commands.ArgUser}),
+	)
+}
+
+// faveSorts are the ways faves can be listed, newest first by default.
+var faveSorts = map[string]string{
+	"added":  "faves.created_at %s, faves.song_id %[1]s",
+	"artist": "artists.name %s, songs.title %[1]s",
+	"title":  "songs.title %s, artists.name %[1]s",
+}
+
+// faveOrder turns a sort and direction from a request into an ORDER BY.
+func faveOrder(sort, direction string) string {
+	clause, ok := faveSorts[sort]
+	if !ok {
+		sort, clause = "added", faveSorts["added"]
+	}
+	if direction != "asc" && direction != "desc" {
+		direction = "asc"
+		if sort == "added" {
+			direction = "desc"
+		}
+	}
+	return fmt.Sprintf(clause, direction)
+}
+
+// listFaves returns a page of user's faves, and how many they have in all. A
+// limit of 0 returns all of them.
+func listFaves(userID uint, order string, offset, limit int) ([]models.Fave, int, error) {
+	var total int
+	if err := db.Model(&models.Fave{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	query := db.Select("faves.*").
+		Joins("JOIN songs ON songs.id = faves.song_id").
+		Joins("JOIN artists ON artists.id = songs.artist_id").
+		Where("faves.user_id = ?", userID).
+		Order(order).
+		Preload("Song").
+		Preload("Song.Artist")
+	if limit > 0 {
+		query = query.Offset(offset).Limit(limit)
+	}
+	var faves []models.Fave
+	err := query.Find(&faves).Error
+	return faves, total, err
+}
+
+func isFave(userID, songID uint) bool {
+	var count int
+	db.Model(&models.Fave{}).Where("user_id = ? AND song_id = ?", userID, songID).Count(&count)
+	return count > 0
+}
+
+// addFave returns false if it was already a fave.
+func addFave(userID, songID uint) (bool, error) {
+	result := db.Exec("INSERT IGNORE INTO faves (user_id, song_id) VALUES (?, ?)", userID, songID)
+	return result.RowsAffected > 0, result.Error
+}
+
+// removeFave returns false if it wasn't a fave.
+func removeFave(userID, songID uint) (bool, error) {
+	result := db.Where("user_id = ? AND song_id = ?", userID, songID).Delete(models.Fave{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// currentSong finds what's playing in the library.
+func currentSong() (*models.Song, bool) {
+	np := CurrentlyPlaying()
+	if np.Title == "" {
+		return nil, false
+	}
+	return findSongByName(np.Artist, np.Title)
+}
+
+// findSongByName looks a song up in the library by what the stream calls it.
+func findSongByName(artist, title string) (*models.Song, bool) {
+	var song models.Song
+	if db.Joins("JOIN artists ON artists.id = songs.artist_id").
+		Where("songs.title = ? AND artists.name = ?", title, artist).
+		Preload("Artist").First(&song).RecordNotFound() {
+		return nil, false
+	}
+	return &song, true
+}
+
+func songName(song *models.Song) string {
+	if song.Artist.Name == "" {
+		return song.Title
+	}
+	return song.Artist.Name + " - " + song.Title
+}
+
+func faveCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	user, song, ok := faveTarget(ctx, msg)
+	if !ok {
+		return
+	}
+	added, err := addFave(user.ID, song.ID)
+	switch {
+	case err != nil:
+		log.Printf("Error adding fave for %s: %s\n", user.Username, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+	case added:
+		ctx.SendToUser(msg.Source, fmt.Sprintf("Added %s to your faves.", songName(song)))
+	default:
+		ctx.SendToUser(msg.Source, fmt.Sprintf("%s is already one of your faves.", songName(song)))
+	}
+}
+
+func unfaveCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	user, song, ok := faveTarget(ctx, msg)
+	if !ok {
+		return
+	}
+	removed, err := removeFave(user.ID, song.ID)
+	switch {
+	case err != nil:
+		log.Printf("Error removing fave for %s: %s\n", user.Username, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+	case removed:
+		ctx.SendToUser(msg.Source, fmt.Sprintf("Removed %s from your faves.", songName(song)))
+	default:
+		ctx.SendToUser(msg.Source, fmt.Sprintf("%s isn't one of your faves.", songName(song)))
+	}
+}
+
+// faveTarget is who's faving what, for .fave and .unfave.
+func faveTarget(ctx commands.CommandContext, msg commands.Message) (*models.User, *models.Song, bool) {
+	user, ok := ctx.Identify(msg.Source)
+	if !ok {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("You need to be linked to an Eden account for that. Use %slink to link one.", ctx.Prefix()))
+		return nil, nil, false
+	}
+	song, ok := currentSong()
+	if !ok {
+		ctx.SendToUser(msg.Source, "I don't know what's playing right now.")
+		return nil, nil, false
+	}
+	return user, song, true
 }
 
-func favesHook(conn *irc.Conn, line *irc.Line) {
+func favesCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	var user *models.User
+	if len(args) > 0 {
+		var ok bool
+		if user, ok = findUser(args[0]); !ok {
+			ctx.SendToUser(msg.Source, fmt.Sprintf("I don't know who %s is.", args[0]))
+			return
+		}
+	} else {
+		var ok bool
+		if user, ok = ctx.Identify(msg.Source); !ok {
+			ctx.SendToUser(msg.Source, fmt.Sprintf("You need to be linked to an Eden account for that. Use %slink to link one.", ctx.Prefix()))
+			return
+		}
+	}
+	faves, total, err := listFaves(user.ID, faveOrder("added", ""), 0, maxFavesListed)
+	if err != nil {
+		log.Printf("Error listing faves for %s: %s\n", user.Username, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	if total == 0 {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("%s hasn't faved anything yet.", user.Username))
+		return
+	}
+	ctx.SendToUser(msg.Source, fmt.Sprintf("%s has %d faves, newest first:", user.Username, total))
+	for _, fave := range faves {
+		ctx.SendToUser(msg.Source, songName(&fave.Song))
+	}
+	if total > len(faves) {
+		text := fmt.Sprintf("...and %d more.", total-len(faves))
+		if config.HTTPPublicURL != "" {
+			text += " See them all at " + publicURL("/users/"+url.PathEscape(user.Username))
+		}
+		ctx.SendToUser(msg.Source, text)
+	}
 }
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	irc "github.com/fluffle/goirc/client"
+	"github.com/fluffle/goirc/state"
 	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/events"
 	"github.com/santiclause/eden/models"
 )
 
 type IrcConn struct {
+	connectionStatus
+	network string
 	// This is a map of nicknames to Eden Users. We store this to cache
 	// nickserv lookups.
 	users            userMap
@@ -24,78 +36,408 @@ type IrcConn struct {
 	nickservPassword string
 	nickservTimeout  time.Duration
 	removers         map[string]irc.Remover
+	// Servers to cycle through when reconnecting. The first one is the
+	// server we initially connect to.
+	servers       []string
+	serverIndex   int
+	saslMechanism string
+	saslUsername  string
+	saslPassword  string
+	saslDone      bool
+	// We do the TLS handshake ourselves, see irc_dial.go.
+	ssl           bool
+	dialerID      string
+	commandPrefix string
+	// If this is empty, every registered command is enabled.
+	enabledCommands []string
+	commands        *commands.CommandSet
+	queue           *sendQueue
+	// Guards the settings that can change on reload: autojoinChannels,
+	// desiredNickname, nickservPassword and commands.
+	settingsMu sync.RWMutex
+	floodRate  float64
+	floodBurst int
+	// Messages that split into more lines than this go to the paste service
+	// instead. Zero means no limit.
+	maxLines int
+	// Fixed CTCP replies by query, overriding the registered handlers.
+	ctcpReplies map[string]string
+	ctcpRate    float64
+	ctcpBurst   int
+	ctcpLimiter *ctcpLimiter
 }
 
 var handlers = map[string]func(*IrcConn) irc.HandlerFunc{
+	irc.CAP:          (*IrcConn).capability,
+	"AUTHENTICATE":   (*IrcConn).authenticate,
+	"903":            (*IrcConn).saslSuccess,
+	"904":            (*IrcConn).saslFailure,
+	"905":            (*IrcConn).saslFailure,
+	"906":            (*IrcConn).saslFailure,
+	"908":            (*IrcConn).saslFailure,
 	irc.CONNECTED:    (*IrcConn).connected,
 	irc.DISCONNECTED: (*IrcConn).disconnected,
 	irc.MODE:         (*IrcConn).mode,
+	irc.JOIN:         (*IrcConn).join,
+	irc.KICK:         (*IrcConn).kick,
 	irc.NICK:         (*IrcConn).nick,
+	irc.NOTICE:       (*IrcConn).notice,
+	irc.ACTION:       (*IrcConn).action,
+	irc.TOPIC:        (*IrcConn).topic,
 	irc.PART:         (*IrcConn).part,
 	irc.PRIVMSG:      (*IrcConn).commandHook,
 	irc.QUIT:         (*IrcConn).quit,
 }
 
+// IrcNetwork is a single network block from the config file. Every network
+// gets its own IrcConn.
+type IrcNetwork struct {
+	Name          string   `yaml:"name"`
+	Servers       []string `yaml:"servers"`
+	TLS           bool     `yaml:"tls"`
+	TLSSkipVerify bool     `yaml:"tls_skip_verify"`
+	TLSCAFile     string   `yaml:"tls_ca_file"`
+	// SHA-256 fingerprint of the server's certificate, for networks with
+	// self-signed certs. Setting this skips the usual chain verification.
+	TLSFingerprint string `yaml:"tls_fingerprint"`
+	TLSCertFile    string `yaml:"tls_cert_file"`
+	TLSKeyFile     string `yaml:"tls_key_file"`
+	Nickname       string `yaml:"nickname"`
+	Ident          string `yaml:"ident"`
+	RealName       string `yaml:"realname"`
+	SaslUsername   string `yaml:"sasl_username"`
+	SaslPassword   string `yaml:"sasl_password"`
+	// Authenticate with the client certificate (CertFP) instead of a password.
+	SaslExternal    bool          `yaml:"sasl_external"`
+	NickservPass    string        `yaml:"nickserv_pass"`
+	NickservTimeout time.Duration `yaml:"nickserv_timeout"`
+	Channels        []string      `yaml:"channels"`
+	QuitMessage     string        `yaml:"quit_message"`
+	CommandPrefix   string        `yaml:"command_prefix"`
+	EnabledCommands []string      `yaml:"commands"`
+	// Outgoing messages per second, and how many we can send in a burst.
+	FloodRate  float64 `yaml:"flood_rate"`
+	FloodBurst int     `yaml:"flood_burst"`
+	MaxLines   int     `yaml:"max_lines"`
+	// Replies to CTCP queries, e.g. VERSION or FINGER. An empty reply stops
+	// us answering that query.
+	CTCPReplies map[string]string `yaml:"ctcp_replies"`
+	// CTCP replies per second to any one host, and how many in a burst.
+	CTCPRate  float64 `yaml:"ctcp_rate"`
+	CTCPBurst int     `yaml:"ctcp_burst"`
+}
+
+// Options turns the network block into the ircOptions for its IrcConn.
+func (n IrcNetwork) Options() []ircOption {
+	return []ircOption{
+		WithServers(n.Servers),
+		WithSSL(n.TLS),
+		WithTLSVerify(!n.TLSSkipVerify),
+		WithTLSCAFile(n.TLSCAFile),
+		WithTLSFingerprint(n.TLSFingerprint),
+		WithTLSClientCert(n.TLSCertFile, n.TLSKeyFile),
+		WithAutojoinChannels(n.Channels),
+		WithIdent(n.Ident),
+		WithName(n.RealName),
+		WithSaslCredentials(n.SaslUsername, n.SaslPassword),
+		WithSaslExternal(n.SaslExternal),
+		WithNickservPassword(n.NickservPass),
+		WithNickservTimeout(n.NickservTimeout),
+		WithVersion(config.Version),
+		WithQuitMessage(n.QuitMessage),
+		WithCommandPrefix(n.CommandPrefix),
+		WithEnabledCommands(n.EnabledCommands),
+		WithFloodControl(n.FloodRate, n.FloodBurst),
+		WithMaxLines(n.MaxLines),
+		WithCTCPReplies(n.CTCPReplies),
+		WithCTCPRateLimit(n.CTCPRate, n.CTCPBurst),
+	}
+}
+
+// NewConn creates an IrcConn for the network, which will connect to the first
+// of the network's servers when started.
+func (n IrcNetwork) NewConn() (*IrcConn, error) {
+	if len(n.Servers) == 0 {
+		return nil, fmt.Errorf("network %s has no servers", n.Name)
+	}
+	return NewIrcConn(n.Servers[0], n.Nickname, append(n.Options(), WithNetworkName(n.Name))...)
+}
+
 // Connects to an IRC server with the given options.
 func Connect(server, nickname string, opts ...ircOption) (*IrcConn, error) {
+	conn, err := NewIrcConn(server, nickname, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Start(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// NewIrcConn sets up a connection to an IRC server with the given options,
+// without connecting yet.
+func NewIrcConn(server, nickname string, opts ...ircOption) (*IrcConn, error) {
 	cfg := irc.NewConfig(nickname)
 	cfg.Server = server
 	conn := &IrcConn{
+		network:         server,
 		cfg:             cfg,
 		users:           makeMap(),
 		desiredNickname: nickname,
 	}
 	for _, opt := range opts {
-		opt(conn)
+		if err := opt(conn); err != nil {
+			return nil, err
+		}
 	}
+	if len(conn.servers) == 0 {
+		conn.servers = []string{server}
+	}
+	conn.setServer(server)
+	conn.commands = commands.NewCommandSet(conn.commandPrefix, conn.enabledCommands)
+	// We do our own flood control in the send queue, and answer CTCP
+	// ourselves so that the replies go through it too.
+	cfg.Flood = true
+	conn.dialerID = nextDialerID()
+	cfg.Proxy = ircDialScheme + "://" + conn.dialerID
+	conn.ctcpLimiter = newCTCPLimiter(conn.ctcpRate, conn.ctcpBurst)
 	conn.conn = irc.Client(cfg)
+	// This has to happen before we connect for the first time.
+	conn.conn.EnableStateTracking()
+	conn.queue = newSendQueue(conn.floodRate, conn.floodBurst, func(line string) {
+		if conn.conn.Connected() {
+			conn.conn.Raw(line)
+		}
+	})
 	conn.removers = make(map[string]irc.Remover)
 	for event, hook := range handlers {
 		// We want to store removers for the internal handlers in case we need to remove them, i.e during connection tear-down.
 		conn.removers[event] = conn.conn.HandleFunc(event, hook(conn))
 	}
-	if err := conn.conn.Connect(); err != nil {
-		return nil, err
-	}
 	return conn, nil
 }
 
-func (c *IrcConn) Close() chan struct{} {
+// Connection interface methods
+
+func (c *IrcConn) Name() string {
+	return "irc:" + c.network
+}
+
+func (c *IrcConn) Start() error {
+	c.setStatus(StatusConnecting)
+	c.queue.start()
+	ircDialers.Store(c.dialerID, c)
+	defer ircDialers.Delete(c.dialerID)
+	if err := c.conn.Connect(); err != nil {
+		c.setStatus(StatusDisconnected)
+		return err
+	}
+	return nil
+}
+
+func (c *IrcConn) Stop() <-chan struct{} {
 	done := make(chan struct{})
-	// We want to remove the reconnect-on-disconnect hook here.
-	c.removers[irc.DISCONNECTED].Remove()
-	c.conn.Quit()
-	c.conn.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) {
+	// Setting the status first stops the disconnect handler from marking us
+	// as disconnected, which would get us restarted.
+	c.setStatus(StatusStopped)
+	c.queue.stop()
+	if !c.conn.Connected() {
+		close(done)
+		return done
+	}
+	var remover irc.Remover
+	remover = c.conn.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) {
 		// Signal completion of connection
+		remover.Remove()
 		close(done)
 	})
+	c.conn.Quit()
 	// Let the calling function decide how to deal with possible failure.
 	return done
 }
 
+func (c *IrcConn) CommandContext() commands.CommandContext {
+	return c
+}
+
+// end interface definitions
+
 func (c *IrcConn) commandHook() irc.HandlerFunc {
 	return func(conn *irc.Conn, line *irc.Line) {
-		message := commands.Message{
-			Content: line.Text(),
-			Public:  line.Public(),
-			Source: commands.User{
-				Name: line.Nick,
-			},
-			Target: line.Target(),
+		message := c.message(line)
+		events.Publish(events.MessageReceived{
+			Source:  c.messageSource(message),
+			Message: message,
+		})
+		c.commandSet().ExecuteCommands(message, c)
+	}
+}
+
+func (c *IrcConn) message(line *irc.Line) commands.Message {
+	return commands.Message{
+		Content: line.Text(),
+		Public:  line.Public(),
+		Source:  c.user(line.Nick),
+		Target:  line.Target(),
+	}
+}
+
+// user fills in what we know about a nick, which is its Eden account if
+// they've been verified with NickServ before.
+func (c *IrcConn) user(nick string) commands.User {
+	user := commands.User{Name: nick}
+	if edenUser, ok := c.users.get(nick); ok && edenUser != nil {
+		user.Account = edenUser.Username
+	}
+	return user
+}
+
+// source is the events.Source for events in the given channel, which may be
+// empty.
+func (c *IrcConn) source(channel string) events.Source {
+	return events.Source{
+		Connection: c.Name(),
+		Context:    c,
+		Channel:    channel,
+		Time:       time.Now(),
+	}
+}
+
+func (c *IrcConn) messageSource(message commands.Message) events.Source {
+	if message.Public {
+		return c.source(message.Target)
+	}
+	return c.source("")
+}
+
+func (c *IrcConn) action() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		message := c.message(line)
+		events.Publish(events.MessageReceived{
+			Source:  c.messageSource(message),
+			Message: message,
+			Action:  true,
+		})
+	}
+}
+
+func (c *IrcConn) notice() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		// Server notices don't come from a nick.
+		if line.Nick == "" || len(line.Args) == 0 {
+			return
 		}
-		commands.ExecuteCommands(message, c)
+		message := c.message(line)
+		events.Publish(events.MessageReceived{
+			Source:  c.messageSource(message),
+			Message: message,
+			Notice:  true,
+		})
+	}
+}
+
+func (c *IrcConn) join() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		events.Publish(events.UserJoined{
+			Source: c.source(line.Target()),
+			User:   c.user(line.Nick),
+		})
+	}
+}
+
+func (c *IrcConn) kick() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		user, kicker := c.user(line.Args[1]), c.user(line.Nick)
+		c.users.remove(line.Args[1])
+		reason := ""
+		if len(line.Args) > 2 {
+			reason = line.Text()
+		}
+		events.Publish(events.UserLeft{
+			Source:   c.source(line.Args[0]),
+			User:     user,
+			Reason:   reason,
+			KickedBy: &kicker,
+		})
+	}
+}
+
+func (c *IrcConn) topic() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		events.Publish(events.TopicChanged{
+			Source: c.source(line.Args[0]),
+			User:   c.user(line.Nick),
+			Topic:  line.Text(),
+		})
+	}
+}
+
+// capability carries on from the CAP REQ that ircDialer sends.
+func (c *IrcConn) capability() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		if c.saslMechanism == "" || len(line.Args) < 3 {
+			return
+		}
+		switch line.Args[1] {
+		case "ACK":
+			conn.Raw("AUTHENTICATE " + c.saslMechanism)
+		case "NAK":
+			log.Printf("%s does not support SASL\n", conn.Config().Server)
+			conn.Cap("END")
+		}
+	}
+}
+
+func (c *IrcConn) authenticate() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		if c.saslMechanism == "" || line.Text() != "+" {
+			return
+		}
+		if c.saslMechanism == "EXTERNAL" {
+			// The server already has our client certificate.
+			conn.Raw("AUTHENTICATE +")
+			return
+		}
+		payload := fmt.Sprintf("%s\x00%s\x00%s", c.saslUsername, c.saslUsername, c.saslPassword)
+		conn.Raw("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(payload)))
+	}
+}
+
+func (c *IrcConn) saslSuccess() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		c.saslDone = true
+		conn.Cap("END")
+	}
+}
+
+func (c *IrcConn) saslFailure() irc.HandlerFunc {
+	return func(conn *irc.Conn, line *irc.Line) {
+		log.Printf("SASL authentication failed on %s: %s\n", conn.Config().Server, line.Text())
+		conn.Cap("END")
 	}
 }
 
 func (c *IrcConn) connected() irc.HandlerFunc {
 	return func(conn *irc.Conn, line *irc.Line) {
-		if c.nickservPassword != "" {
-			if conn.Me().Nick != c.desiredNickname {
+		c.setStatus(StatusConnected)
+		nickname, password := c.nickservCredentials()
+		if c.saslDone && conn.Me().Nick == nickname {
+			// We're already identified to services.
+			c.Autojoin()
+		} else if password != "" {
+			if conn.Me().Nick != nickname {
 				time.AfterFunc(1*time.Second, func() {
 					c.ghost()
 				})
 			} else {
-				conn.Privmsgf("NickServ", "IDENTIFY %s", c.nickservPassword)
+				c.nickserv("IDENTIFY %s", password)
 			}
 		} else {
 			c.Autojoin()
@@ -105,20 +447,28 @@ func (c *IrcConn) connected() irc.HandlerFunc {
 
 func (c *IrcConn) disconnected() irc.HandlerFunc {
 	return func(conn *irc.Conn, line *irc.Line) {
-		conn.Connect()
+		c.queue.clear()
+		// Move on to the next server, if we've got more than one.
+		c.serverIndex = (c.serverIndex + 1) % len(c.servers)
+		c.setServer(c.servers[c.serverIndex])
+		// The connection manager takes care of reconnecting us.
+		if c.Status() != StatusStopped {
+			c.setStatus(StatusDisconnected)
+		}
 	}
 }
 
 func (c *IrcConn) ghost() {
-	c.conn.Privmsgf("NickServ", "RECOVER %s %s", c.desiredNickname, c.nickservPassword)
+	nickname, password := c.nickservCredentials()
+	c.nickserv("RECOVER %s %s", nickname, password)
 	var remover irc.Remover
 	remover = c.conn.HandleFunc(irc.NOTICE, func(conn *irc.Conn, line *irc.Line) {
 		if line.Target() == "NickServ" {
 			if line.Text() == "User claiming your nick has been killed." {
-				conn.Privmsgf("NickServ", "RELEASE %s %s", c.desiredNickname, c.nickservPassword)
+				c.nickserv("RELEASE %s %s", nickname, password)
 			} else if line.Text() == "Services' hold on your nick has been released." {
-				conn.Nick(c.desiredNickname)
-				conn.Privmsgf("NickServ", "IDENTIFY %s", c.nickservPassword)
+				conn.Nick(nickname)
+				c.nickserv("IDENTIFY %s", password)
 				remover.Remove()
 			}
 		}
@@ -135,19 +485,41 @@ func (c *IrcConn) mode() irc.HandlerFunc {
 
 func (c *IrcConn) quit() irc.HandlerFunc {
 	return func(conn *irc.Conn, line *irc.Line) {
+		user := c.user(line.Nick)
 		c.users.remove(line.Nick)
+		events.Publish(events.UserLeft{
+			Source: c.source(""),
+			User:   user,
+			Reason: line.Text(),
+		})
 	}
 }
 
 func (c *IrcConn) part() irc.HandlerFunc {
 	return func(conn *irc.Conn, line *irc.Line) {
+		user := c.user(line.Nick)
 		c.users.remove(line.Nick)
+		reason := ""
+		if len(line.Args) > 1 {
+			reason = line.Text()
+		}
+		events.Publish(events.UserLeft{
+			Source: c.source(line.Target()),
+			User:   user,
+			Reason: reason,
+		})
 	}
 }
 
 func (c *IrcConn) nick() irc.HandlerFunc {
 	return func(conn *irc.Conn, line *irc.Line) {
+		user := c.user(line.Nick)
 		c.users.remove(line.Nick)
+		events.Publish(events.NickChanged{
+			Source: c.source(""),
+			Old:    user,
+			New:    commands.User{Name: line.Text()},
+		})
 	}
 }
 
@@ -187,140 +559,456 @@ func (c *IrcConn) Execute(f commands.ExecuteFunc, message commands.Message, args
 }
 
 func (c *IrcConn) Authorize(userInfo commands.User, permission models.Permission) bool {
-	user, ok := c.users.get(userInfo.Name)
-
-	// Cache miss, we don't have any information about this user
+	user, ok := c.Identify(userInfo)
 	if !ok {
-		timeout := time.After(c.nickservTimeout)
-		wait := make(chan bool, 1)
-		remover := c.conn.HandleFunc(irc.PRIVMSG, func(conn *irc.Conn, line *irc.Line) {
-			if line.Nick == "NickServ" && !line.Public() {
-				if ok, _ := regexp.MatchString(fmt.Sprintf("^STATUS %s \\d$", regexp.QuoteMeta(userInfo.Name)), line.Text()); ok {
-					if strings.HasSuffix(line.Text(), "3") {
-						wait <- true
-					} else {
-						wait <- false
-					}
-				}
-			}
-		})
-		c.conn.Privmsgf("NickServ", "STATUS %s", userInfo.Name)
-		select {
-		case ok = <-wait:
-		case <-timeout:
-		}
-		remover.Remove()
-		if ok {
-			// This user is registered and identified with NickServ, so we want to
-			// at least cache that this user is verified by NickServ.
-			c.users.set(userInfo.Name, nil)
-		} else {
-			return false
-		}
-	}
-
-	// Cache hit (or successful check with NickServ), but we don't have an Eden user for them yet.
-	if user == nil {
-		ircUser := models.IrcUser{
-			Nickname: userInfo.Name,
-		}
-		if db.Where(&ircUser).First(&ircUser).RecordNotFound() {
-			return false
-		}
-		user = new(models.User)
-		if err := db.Model(&ircUser).Related(user).Error; err != nil {
-			log.Printf("Error fetching user for ircUser: %s\n", err)
-			return false
-		}
-		// Cache the Eden user
-		c.users.set(userInfo.Name, user)
+		return false
 	}
-
 	if err := user.GetPermissions(db); err != nil {
 		log.Printf("Error fetching user permissions: %s\n", err)
 		return false
 	}
 	for _, p := range user.Permissions {
-		if p == permission {
+		if p.Name == permission.Name {
 			return true
 		}
 	}
 	return false
 }
 
+// Identify looks the nick up in ircUsers and, if it's there, checks that
+// they're identified with NickServ before trusting it.
+func (c *IrcConn) Identify(userInfo commands.User) (*models.User, bool) {
+	user, ok := c.users.get(userInfo.Name)
+	if ok && user != nil {
+		return user, true
+	}
+
+	ircUser := models.IrcUser{
+		Nickname: userInfo.Name,
+	}
+	if db.Where(&ircUser).First(&ircUser).RecordNotFound() {
+		return nil, false
+	}
+
+	// Cache miss, we don't have any information about this user
+	if !ok && !c.nickservVerified(userInfo.Name) {
+		return nil, false
+	}
+
+	// Verified by NickServ, so fetch and cache the Eden user.
+	user = new(models.User)
+	if err := db.Model(&ircUser).Related(user).Error; err != nil {
+		log.Printf("Error fetching user for ircUser: %s\n", err)
+		return nil, false
+	}
+	c.users.set(userInfo.Name, user)
+	return user, true
+}
+
 func (c *IrcConn) SendToUser(userInfo commands.User, message string) {
-	c.conn.Privmsg(userInfo.Name, message)
+	c.privmsg(priorityNormal, userInfo.Name, message)
 }
 
 func (c *IrcConn) SendToChannel(channel, message string) {
-	c.conn.Privmsg(channel, message)
+	c.privmsg(priorityNormal, channel, message)
+}
+
+func (c *IrcConn) Channel(name string) (*commands.Channel, bool) {
+	st := c.conn.StateTracker()
+	ch := st.GetChannel(name)
+	if ch == nil {
+		return nil, false
+	}
+	channel := &commands.Channel{
+		Name:  ch.Name,
+		Topic: ch.Topic,
+	}
+	for nick, privs := range ch.Nicks {
+		channel.Members = append(channel.Members, commands.Member{
+			User:       commands.User{Name: nick},
+			Privileges: ircPrivileges(privs),
+		})
+	}
+	if privs, ok := st.IsOn(name, st.Me().Nick); ok {
+		channel.Me = ircPrivileges(privs)
+	}
+	return channel, true
+}
+
+func (c *IrcConn) Prefix() string {
+	return c.commandSet().Prefix()
 }
 
 // end interface definitions
 
-func (c *IrcConn) Autojoin() {
-	if c.autojoinChannels == nil {
-		return
+func ircPrivileges(privs *state.ChanPrivs) commands.Privileges {
+	return commands.Privileges{
+		Owner:  privs.Owner,
+		Admin:  privs.Admin,
+		Op:     privs.Op,
+		HalfOp: privs.HalfOp,
+		Voice:  privs.Voice,
+	}
+}
+
+// linker interface methods
+
+func (c *IrcConn) platformIdentity(userInfo commands.User) platformIdentity {
+	return platformIdentity{
+		Platform: "irc",
+		Identity: userInfo.Name,
+		Name:     userInfo.Name,
+	}
+}
+
+func (c *IrcConn) verifyIdentity(userInfo commands.User) bool {
+	return c.nickservVerified(userInfo.Name)
+}
+
+// end interface definitions
+
+// nickservVerified asks NickServ whether nick is registered and identified.
+func (c *IrcConn) nickservVerified(nick string) bool {
+	timeout := time.After(c.nickservTimeout)
+	wait := make(chan bool, 1)
+	remover := c.conn.HandleFunc(irc.PRIVMSG, func(conn *irc.Conn, line *irc.Line) {
+		if line.Nick == "NickServ" && !line.Public() {
+			if ok, _ := regexp.MatchString(fmt.Sprintf("^STATUS %s \\d$", regexp.QuoteMeta(nick)), line.Text()); ok {
+				if strings.HasSuffix(line.Text(), "3") {
+					wait <- true
+				} else {
+					wait <- false
+				}
+			}
+		}
+	})
+	defer remover.Remove()
+	c.nickserv("STATUS %s", nick)
+	select {
+	case ok := <-wait:
+		return ok
+	case <-timeout:
+		return false
+	}
+}
+
+func (c *IrcConn) commandSet() *commands.CommandSet {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return c.commands
+}
+
+func (c *IrcConn) nickservCredentials() (nickname, password string) {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return c.desiredNickname, c.nickservPassword
+}
+
+func (c *IrcConn) nickserv(format string, args ...interface{}) {
+	c.privmsg(priorityServices, "NickServ", fmt.Sprintf(format, args...))
+}
+
+// privmsg queues a message to target, split into as many lines as it takes.
+// If there are too many lines and we have a paste service, the rest of the
+// message is pasted instead.
+func (c *IrcConn) privmsg(priority sendPriority, target, message string) {
+	prefix := irc.PRIVMSG + " " + target + " :"
+	lines := splitMessage(message, maxLineLength-c.lineOverhead(prefix))
+	if c.maxLines > 0 && len(lines) > c.maxLines && config.PasteURL != "" {
+		if url, err := paste(message); err == nil {
+			lines = append(lines[:c.maxLines-1], fmt.Sprintf("... %d more lines at %s", len(lines)-c.maxLines+1, url))
+		} else {
+			log.Printf("Error pasting long message: %s\n", err)
+		}
+	}
+	for i, line := range lines {
+		lines[i] = prefix + line
+	}
+	c.queue.push(priority, lines...)
+}
+
+// lineOverhead is the number of bytes the server will add to a line we send
+// with the given prefix, when it relays it as ":nick!ident@host <prefix>".
+func (c *IrcConn) lineOverhead(prefix string) int {
+	me := c.conn.Me()
+	hostLength := len(me.Host)
+	if hostLength == 0 {
+		hostLength = maxHostLength
+	}
+	// ":" + nick + "!" + ident + "@" + host + " " + prefix + "\r\n"
+	return 1 + len(me.Nick) + 1 + len(me.Ident) + 1 + hostLength + 1 + len(prefix) + 2
+}
+
+func (c *IrcConn) setServer(server string) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		// goirc would pick the port for us, but it thinks we're not using
+		// TLS.
+		host = server
+		if c.ssl {
+			server = net.JoinHostPort(server, "6697")
+		} else {
+			server = net.JoinHostPort(server, "6667")
+		}
+	}
+	c.cfg.Server = server
+	if c.ssl {
+		c.tlsConfig().ServerName = host
+	}
+}
+
+func (c *IrcConn) tlsConfig() *tls.Config {
+	if c.cfg.SSLConfig == nil {
+		c.cfg.SSLConfig = &tls.Config{}
+	}
+	return c.cfg.SSLConfig
+}
+
+// verifyFingerprint returns a tls.Config.VerifyPeerCertificate function that
+// only accepts a leaf certificate with the given SHA-256 fingerprint.
+func verifyFingerprint(fingerprint []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server sent no certificates")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if !hmac.Equal(sum[:], fingerprint) {
+			return fmt.Errorf("certificate fingerprint %x does not match pinned fingerprint %x", sum, fingerprint)
+		}
+		return nil
 	}
-	for _, channel := range c.autojoinChannels {
+}
+
+func (c *IrcConn) Autojoin() {
+	c.settingsMu.RLock()
+	channels := c.autojoinChannels
+	c.settingsMu.RUnlock()
+	for _, channel := range channels {
 		c.conn.Join(channel)
 	}
 }
 
-type ircOption func(*IrcConn)
+type ircOption func(*IrcConn) error
 
 func WithAutojoinChannels(channels []string) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		c.autojoinChannels = channels
+		return nil
+	}
+}
+
+func WithCommandPrefix(prefix string) ircOption {
+	return func(c *IrcConn) error {
+		c.commandPrefix = prefix
+		return nil
+	}
+}
+
+func WithEnabledCommands(names []string) ircOption {
+	return func(c *IrcConn) error {
+		c.enabledCommands = names
+		return nil
+	}
+}
+
+func WithCTCPReplies(replies map[string]string) ircOption {
+	return func(c *IrcConn) error {
+		c.ctcpReplies = ctcpReplyMap(replies)
+		return nil
+	}
+}
+
+func WithCTCPRateLimit(rate float64, burst int) ircOption {
+	return func(c *IrcConn) error {
+		c.ctcpRate = rate
+		c.ctcpBurst = burst
+		return nil
+	}
+}
+
+func WithFloodControl(rate float64, burst int) ircOption {
+	return func(c *IrcConn) error {
+		c.floodRate = rate
+		c.floodBurst = burst
+		return nil
 	}
 }
 
 func WithIdent(ident string) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		if ident != "" {
 			c.cfg.Me.Ident = ident
 		}
+		return nil
+	}
+}
+
+func WithMaxLines(maxLines int) ircOption {
+	return func(c *IrcConn) error {
+		c.maxLines = maxLines
+		return nil
 	}
 }
 
 func WithName(name string) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		if name != "" {
 			c.cfg.Me.Name = name
 		}
+		return nil
 	}
 }
 
 func WithNickservPassword(password string) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		c.nickservPassword = password
+		return nil
 	}
 }
 
 func WithNickservTimeout(timeout time.Duration) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		c.nickservTimeout = timeout
+		return nil
+	}
+}
+
+// WithNetworkName names the connection. This defaults to the server name.
+func WithNetworkName(name string) ircOption {
+	return func(c *IrcConn) error {
+		if name != "" {
+			c.network = name
+		}
+		return nil
 	}
 }
 
 func WithQuitMessage(quitMessage string) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		if quitMessage != "" {
 			c.cfg.QuitMessage = quitMessage
 		}
+		return nil
+	}
+}
+
+func WithSaslCredentials(username, password string) ircOption {
+	return func(c *IrcConn) error {
+		if username != "" {
+			c.saslMechanism = "PLAIN"
+			c.saslUsername = username
+			c.saslPassword = password
+		}
+		return nil
+	}
+}
+
+// WithSaslExternal authenticates with SASL EXTERNAL, which needs a client
+// certificate set with WithTLSClientCert.
+func WithSaslExternal(external bool) ircOption {
+	return func(c *IrcConn) error {
+		if external {
+			c.saslMechanism = "EXTERNAL"
+		}
+		return nil
+	}
+}
+
+func WithServers(servers []string) ircOption {
+	return func(c *IrcConn) error {
+		if len(servers) > 0 {
+			c.servers = servers
+		}
+		return nil
+	}
+}
+
+func WithSSL(ssl bool) ircOption {
+	return func(c *IrcConn) error {
+		c.ssl = ssl
+		return nil
+	}
+}
+
+// WithTLSCAFile trusts the PEM encoded certificates in the given file instead
+// of the system roots.
+func WithTLSCAFile(filename string) ircOption {
+	return func(c *IrcConn) error {
+		if filename == "" {
+			return nil
+		}
+		pem, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", filename)
+		}
+		c.tlsConfig().RootCAs = pool
+		return nil
+	}
+}
+
+// WithTLSClientCert presents a client certificate to the server, for CertFP.
+func WithTLSClientCert(certFile, keyFile string) ircOption {
+	return func(c *IrcConn) error {
+		if certFile == "" {
+			return nil
+		}
+		if keyFile == "" {
+			// The key is allowed to live in the same file as the cert.
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		c.tlsConfig().Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithTLSFingerprint pins the server's certificate to a hex encoded SHA-256
+// fingerprint, optionally separated by colons.
+func WithTLSFingerprint(fingerprint string) ircOption {
+	return func(c *IrcConn) error {
+		if fingerprint == "" {
+			return nil
+		}
+		sum, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 fingerprint %q", fingerprint)
+		}
+		cfg := c.tlsConfig()
+		// The fingerprint check replaces the chain verification.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyFingerprint(sum)
+		return nil
+	}
+}
+
+func WithTLSVerify(verify bool) ircOption {
+	return func(c *IrcConn) error {
+		if !verify {
+			c.tlsConfig().InsecureSkipVerify = true
+		}
+		return nil
 	}
 }
 
 func WithTimeout(timeout time.Duration) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		c.cfg.Timeout = timeout
+		return nil
 	}
 }
 
 func WithVersion(version string) ircOption {
-	return func(c *IrcConn) {
+	return func(c *IrcConn) error {
 		if version != "" {
 			c.cfg.Version = version
 		}
+		return nil
 	}
 }
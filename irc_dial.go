@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	irc "github.com/fluffle/goirc/client"
+	"golang.org/x/net/proxy"
+)
+
+// goirc only lets us near the socket through its proxy support, so every
+// IrcConn dials through a proxy scheme of our own. That gives us the
+// connection before goirc writes NICK and USER to it, and every line before
+// goirc's handlers see it.
+const ircDialScheme = "eden-irc"
+
+var (
+	// IrcConns that are in the middle of connecting, by dialer ID.
+	ircDialers sync.Map
+	lastDialer uint64
+)
+
+func init() {
+	proxy.RegisterDialerType(ircDialScheme, func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		c, ok := ircDialers.Load(u.Host)
+		if !ok {
+			return nil, fmt.Errorf("irc: no connection to dial for %s", u.Host)
+		}
+		return &ircDialer{c: c.(*IrcConn), forward: forward}, nil
+	})
+}
+
+func nextDialerID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastDialer, 1), 10)
+}
+
+type ircDialer struct {
+	c       *IrcConn
+	forward proxy.Dialer
+}
+
+// Dial connects to the server, doing the TLS handshake ourselves so that we
+// can talk to the server before goirc does. If we have SASL credentials we
+// ask for the capability straight away: servers hold off on finishing
+// registration until CAP END, but only if CAP comes before NICK and USER.
+func (d *ircDialer) Dial(network, addr string) (net.Conn, error) {
+	sock, err := d.forward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.c.ssl {
+		tlsSock := tls.Client(sock, d.c.tlsConfig())
+		if err := tlsSock.Handshake(); err != nil {
+			sock.Close()
+			return nil, err
+		}
+		sock = tlsSock
+	}
+	d.c.saslDone = false
+	if d.c.saslMechanism != "" {
+		if _, err := fmt.Fprintf(sock, "%s REQ :sasl\r\n", irc.CAP); err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	return &ircSocket{Conn: sock, c: d.c, r: bufio.NewReader(sock)}, nil
+}
+
+// ircSocket takes CTCP queries off the wire and answers them itself, so that
+// goirc never sees them and can't answer VERSION and PING around our rate
+// limiting.
+type ircSocket struct {
+	net.Conn
+	c *IrcConn
+	r *bufio.Reader
+	// What's left of the last line we read.
+	pending []byte
+	err     error
+}
+
+func (s *ircSocket) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		line, err := s.r.ReadString('\n')
+		s.err = err
+		if err == nil && s.intercept(line) {
+			continue
+		}
+		s.pending = []byte(line)
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// intercept answers the line if it's a CTCP query, and reports whether it
+// did.
+func (s *ircSocket) intercept(raw string) bool {
+	line := irc.ParseLine(strings.Trim(raw, "\r\n"))
+	if line == nil || line.Cmd != irc.CTCP {
+		return false
+	}
+	s.c.answerCTCP(line)
+	return true
+}
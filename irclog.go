@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/events"
+	"github.com/santiclause/eden/models"
+)
+
+const grepResults = 5
+
+func init() {
+	commands.NewCommand("grep", grepCommand,
+		commands.WithArgs(1),
+		commands.WithPermissionCheck(models.Permission{Name: "super"}),
+		commands.WithDescription("Search the IRC logs"),
+		commands.WithArgSpec(commands.Arg{Name: "pattern", Description: "A regular expression"}),
+	)
+}
+
+// startIrcLogging logs channel activity on every IRC network, and prunes old
+// entries if there's a retention period set. Events are logged in order, so
+// that entries with the same timestamp still come out the right way round.
+func startIrcLogging() {
+	events.SubscribeOrdered(logIrcEvent, func(e events.Event) bool {
+		_, ok := ircSource(e)
+		return ok
+	})
+	go pruneIrcLog()
+}
+
+// ircSource returns the source of events from IRC connections.
+func ircSource(e events.Event) (events.Source, bool) {
+	var source events.Source
+	switch e := e.(type) {
+	case events.UserJoined:
+		source = e.Source
+	case events.UserLeft:
+		source = e.Source
+	case events.NickChanged:
+		source = e.Source
+	case events.TopicChanged:
+		source = e.Source
+	case events.MessageReceived:
+		source = e.Source
+	default:
+		return events.Source{}, false
+	}
+	return source, strings.HasPrefix(source.Connection, "irc:")
+}
+
+func logIrcEvent(e events.Event) {
+	source, _ := ircSource(e)
+	entry := models.IrcLog{
+		Network:   strings.TrimPrefix(source.Connection, "irc:"),
+		Timestamp: source.Time,
+	}
+	var user commands.User
+	switch e := e.(type) {
+	case events.MessageReceived:
+		if e.Channel == "" {
+			// We don't log private messages.
+			return
+		}
+		entry.Type = "PRIVMSG"
+		if e.Action {
+			entry.Type = "ACTION"
+		} else if e.Notice {
+			entry.Type = "NOTICE"
+		}
+		entry.Channel = e.Channel
+		entry.Text = e.Message.Content
+		user = e.Message.Source
+	case events.UserJoined:
+		entry.Type = "JOIN"
+		entry.Channel = e.Channel
+		user = e.User
+	case events.UserLeft:
+		entry.Channel = e.Channel
+		entry.Text = e.Reason
+		user = e.User
+		if e.KickedBy != nil {
+			entry.Type = "KICK"
+			entry.Target = e.User.Name
+			user = *e.KickedBy
+		} else if e.Channel == "" {
+			entry.Type = "QUIT"
+		} else {
+			entry.Type = "PART"
+		}
+	case events.NickChanged:
+		entry.Type = "NICK"
+		entry.Target = e.New.Name
+		user = e.Old
+	case events.TopicChanged:
+		entry.Type = "TOPIC"
+		entry.Channel = e.Channel
+		entry.Text = e.Topic
+		user = e.User
+	}
+	entry.Nick = user.Name
+	entry.Account = user.Account
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Error logging IRC %s: %s\n", entry.Type, err)
+	}
+}
+
+func pruneIrcLog() {
+	for range time.Tick(time.Hour) {
+		if config.IrcLogRetention <= 0 {
+			continue
+		}
+		cutoff := time.Now().Add(-config.IrcLogRetention)
+		if err := db.Where("timestamp < ?", cutoff).Delete(models.IrcLog{}).Error; err != nil {
+			log.Printf("Error pruning IRC log: %s\n", err)
+		}
+	}
+}
+
+// grepCommand sends the latest lines matching a regular expression to the
+// user privately. Used in a channel, it only searches that channel.
+func grepCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	query := db.Where("text REGEXP ?", args[0])
+	if msg.Public {
+		query = query.Where("channel = ?", msg.Target)
+	}
+	var entries []models.IrcLog
+	if err := query.Order("timestamp desc").Limit(grepResults).Find(&entries).Error; err != nil {
+		log.Printf("Error grepping the IRC log for %q: %s\n", args[0], err)
+		ctx.SendToUser(msg.Source, "Couldn't search for that. Check it's a valid regular expression.")
+		return
+	}
+	if len(entries) == 0 {
+		ctx.SendToUser(msg.Source, "No matches.")
+		return
+	}
+	// Oldest first, like a log.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		ctx.SendToUser(msg.Source, fmt.Sprintf("[%s %s] %s", entry.Timestamp.Format("2006-01-02 15:04"), entry.Channel, formatLogEntry(entry)))
+	}
+}
+
+// describeLogEntry describes what someone was doing, for .seen.
+func describeLogEntry(entry models.IrcLog) string {
+	switch entry.Type {
+	case "PRIVMSG", "NOTICE":
+		return fmt.Sprintf("in %s saying: %s", entry.Channel, entry.Text)
+	case "ACTION":
+		return fmt.Sprintf("in %s: * %s %s", entry.Channel, entry.Nick, entry.Text)
+	case "JOIN":
+		return fmt.Sprintf("joining %s.", entry.Channel)
+	case "PART":
+		return fmt.Sprintf("leaving %s.", entry.Channel)
+	case "QUIT":
+		return fmt.Sprintf("quitting (%s).", entry.Text)
+	case "KICK":
+		return fmt.Sprintf("kicking %s from %s.", entry.Target, entry.Channel)
+	case "NICK":
+		return fmt.Sprintf("changing nick to %s.", entry.Target)
+	case "TOPIC":
+		return fmt.Sprintf("changing the topic of %s to: %s", entry.Channel, entry.Text)
+	}
+	return "doing something."
+}
+
+// formatLogEntry formats an entry the way irssi does, minus the timestamp.
+func formatLogEntry(entry models.IrcLog) string {
+	switch entry.Type {
+	case "PRIVMSG":
+		return fmt.Sprintf("<%s> %s", entry.Nick, entry.Text)
+	case "NOTICE":
+		return fmt.Sprintf("-%s:%s- %s", entry.Nick, entry.Channel, entry.Text)
+	case "ACTION":
+		return fmt.Sprintf(" * %s %s", entry.Nick, entry.Text)
+	case "JOIN":
+		return fmt.Sprintf("-!- %s has joined %s", entry.Nick, entry.Channel)
+	case "PART":
+		return fmt.Sprintf("-!- %s has left %s [%s]", entry.Nick, entry.Channel, entry.Text)
+	case "QUIT":
+		return fmt.Sprintf("-!- %s has quit [%s]", entry.Nick, entry.Text)
+	case "KICK":
+		return fmt.Sprintf("-!- %s was kicked from %s by %s [%s]", entry.Target, entry.Channel, entry.Nick, entry.Text)
+	case "NICK":
+		return fmt.Sprintf("-!- %s is now known as %s", entry.Nick, entry.Target)
+	case "TOPIC":
+		return fmt.Sprintf("-!- %s changed the topic of %s to: %s", entry.Nick, entry.Channel, entry.Text)
+	}
+	return entry.Text
+}
+
+// formatAge gives a rough, human friendly idea of how long ago t was.
+func formatAge(t time.Time) string {
+	age := time.Since(t)
+	switch {
+	case age < time.Minute:
+		return pluralize(int(age.Seconds()), "second")
+	case age < time.Hour:
+		return pluralize(int(age.Minutes()), "minute")
+	case age < 24*time.Hour:
+		return pluralize(int(age.Hours()), "hour")
+	}
+	return pluralize(int(age.Hours()/24), "day")
+}
+
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// exportIrcLogs writes the whole log out as irssi style text files, one per
+// channel, under dir/<network>/. Quits and nick changes go in server.log.
+func exportIrcLogs(dir string) error {
+	rows, err := db.Model(&models.IrcLog{}).Order("network, channel, timestamp, id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		file     *os.File
+		out      *bufio.Writer
+		current  string
+		lastDate string
+	)
+	closeFile := func() error {
+		if file == nil {
+			return nil
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	for rows.Next() {
+		var entry models.IrcLog
+		if err := db.ScanRows(rows, &entry); err != nil {
+			closeFile()
+			return err
+		}
+		timestamp := entry.Timestamp.Local()
+		if name := logFilename(dir, entry); name != current {
+			if err := closeFile(); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if file, err = os.Create(name); err != nil {
+				return err
+			}
+			out = bufio.NewWriter(file)
+			current = name
+			lastDate = timestamp.Format("2006-01-02")
+			fmt.Fprintf(out, "--- Log opened %s\n", timestamp.Format("Mon Jan 02 15:04:05 2006"))
+		}
+		if date := timestamp.Format("2006-01-02"); date != lastDate {
+			fmt.Fprintf(out, "--- Day changed %s\n", timestamp.Format("Mon Jan 02 2006"))
+			lastDate = date
+		}
+		fmt.Fprintf(out, "%s %s\n", timestamp.Format("15:04"), formatLogEntry(entry))
+	}
+	if err := rows.Err(); err != nil {
+		closeFile()
+		return err
+	}
+	return closeFile()
+}
+
+func logFilename(dir string, entry models.IrcLog) string {
+	channel := strings.ToLower(entry.Channel)
+	if channel == "" {
+		channel = "server"
+	}
+	clean := func(s string) string {
+		return strings.Replace(s, string(filepath.Separator), "_", -1)
+	}
+	return filepath.Join(dir, clean(entry.Network), clean(channel)+".log")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/santiclause/eden/commands"
+)
+
+const (
+	// InnoDB doesn't index words shorter than this, so we can't full-text
+	// search for them.
+	minFulltextTerm = 3
+	maxSearchTerms  = 8
+	maxSearchListed = 5
+)
+
+func init() {
+	commands.NewCommand("search", searchCommand,
+		commands.WithVarArgs(1, maxSearchTerms),
+		commands.WithDescription("Search the library by title and artist"),
+		commands.WithArgSpec(commands.Arg{Name: "terms", Description: "What to look for", Rest: true}),
+	)
+}
+
+// songQuery is a search of the library. Everything is optional.
+type songQuery struct {
+	Terms    string
+	ArtistID uint
+	// One of librarySorts.
+	Sort   string
+	Offset int
+	Limit  int
+}
+
+// librarySong is a song along with how popular it is.
+type librarySong struct {
+	ID         uint
+	Title      string
+	Album      string
+	Duration   uint
+	ArtistID   uint
+	ArtistName string
+	Plays      int
+	Faves      int
+	LastPlayed *time.Time
+}
+
+func (s librarySong) String() string {
+	return s.ArtistName + " - " + s.Title
+}
+
+var librarySorts = map[string]string{
+	"artist": "artists.name, songs.title",
+	"title":  "songs.title, artists.name",
+	"plays":  "plays DESC, artists.name, songs.title",
+	"faves":  "faves DESC, artists.name, songs.title",
+	"played": "last_played DESC, artists.name, songs.title",
+}
+
+// searchSongs runs q, returning a page of songs and how many there are in
+// all.
+func searchSongs(q songQuery) ([]librarySong, int, error) {
+	query := libraryQuery()
+	for _, term := range searchTerms(q.Terms) {
+		query = whereTerm(query, term)
+	}
+	if q.ArtistID != 0 {
+		query = query.Where("songs.artist_id = ?", q.ArtistID)
+	}
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	order, ok := librarySorts[q.Sort]
+	if !ok {
+		order = librarySorts["artist"]
+	}
+	query = withLibraryStats(query).Order(order)
+	if q.Limit > 0 {
+		query = query.Offset(q.Offset).Limit(q.Limit)
+	}
+	var songs []librarySong
+	err := query.Scan(&songs).Error
+	return songs, total, err
+}
+
+func libraryQuery() *gorm.DB {
+	return db.Table("songs").Joins("JOIN artists ON artists.id = songs.artist_id")
+}
+
+// withLibraryStats selects librarySongs from a libraryQuery. Play counts come
+// from the playStatsHourly rollup, grouped once rather than counted song by
+// song, so they can be up to config.StatsRefreshInterval behind.
+func withLibraryStats(query *gorm.DB) *gorm.DB {
+	return query.
+		Joins("LEFT JOIN (SELECT song_id, SUM(plays) AS plays FROM playStatsHourly GROUP BY song_id) AS songPlays ON songPlays.song_id = songs.id").
+		Joins("LEFT JOIN (SELECT song_id, COUNT(*) AS faves FROM faves GROUP BY song_id) AS songFaves ON songFaves.song_id = songs.id").
+		Select("songs.id, songs.title, songs.album, songs.duration, songs.artist_id, artists.name AS artist_name, " +
+			"COALESCE(songPlays.plays, 0) AS plays, COALESCE(songFaves.faves, 0) AS faves, " +
+			"(SELECT MAX(played) FROM playHistory WHERE playHistory.song_id = songs.id) AS last_played")
+}
+
+// findLibrarySong looks up one song, with its stats.
+func findLibrarySong(id uint) (*librarySong, bool) {
+	var songs []librarySong
+	if err := withLibraryStats(libraryQuery()).Where("songs.id = ?", id).Scan(&songs).Error; err != nil {
+		log.Printf("Error fetching song %d: %s\n", id, err)
+	}
+	if len(songs) == 0 {
+		return nil, false
+	}
+	return &songs[0], true
+}
+
+// favedBy lists who's faved a song, earliest first.
+func favedBy(songID uint) ([]string, error) {
+	var names []string
+	err := db.Table("faves").Joins("JOIN users ON users.id = faves.user_id").
+		Where("faves.song_id = ?", songID).Order("faves.created_at").Pluck("users.username", &names).Error
+	return names, err
+}
+
+// searchTerms splits a search into words, dropping anything MySQL would take
+// as a boolean operator.
+func searchTerms(s string) []string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`+-<>()~*"@`, r) {
+			return ' '
+		}
+		return r
+	}, s)
+	terms := strings.Fields(s)
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// InnoDB's default full-text stopwords, which it leaves out of the index.
+var fulltextStopwords = map[string]bool{
+	"a": true, "about": true, "an": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "com": true, "de": true, "en": true, "for": true,
+	"from": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"la": true, "of": true, "on": true, "or": true, "that": true, "the": true,
+	"this": true, "to": true, "was": true, "what": true, "when": true,
+	"where": true, "who": true, "will": true, "with": true, "und": true,
+	"www": true,
+}
+
+// whereTerm matches songs with term in either the title or the artist, as a
+// prefix. Words the full-text index leaves out, because they're short or
+// stopwords, fall back to LIKE, which is slower but works.
+func whereTerm(query *gorm.DB, term string) *gorm.DB {
+	if len([]rune(term)) < minFulltextTerm || fulltextStopwords[strings.ToLower(term)] {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+		return query.Where("(songs.title LIKE ? OR artists.name LIKE ?)", like, like)
+	}
+	match := term + "*"
+	return query.Where("(MATCH (songs.title) AGAINST (? IN BOOLEAN MODE) OR MATCH (artists.name) AGAINST (? IN BOOLEAN MODE))", match, match)
+}
+
+func searchCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	terms := strings.Join(args, " ")
+	songs, total, err := searchSongs(songQuery{
+		Terms: terms,
+		Sort:  "plays",
+		Limit: maxSearchListed,
+	})
+	if err != nil {
+		log.Printf("Error searching for %s: %s\n", terms, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	if total == 0 {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("Nothing found for %s.", terms))
+		return
+	}
+	ctx.SendToUser(msg.Source, fmt.Sprintf("%d found for %s, most played first:", total, terms))
+	for _, song := range songs {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("#%d %s (%d plays, %d faves)", song.ID, song, song.Plays, song.Faves))
+	}
+	if total > len(songs) {
+		text := fmt.Sprintf("...and %d more.", total-len(songs))
+		if config.HTTPPublicURL != "" {
+			text += " See them all at " + publicURL("/songs?"+url.Values{"q": {terms}, "sort": {"plays"}}.Encode())
+		}
+		ctx.SendToUser(msg.Source, text)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	linkCodeLength   = 8
+	linkCodeLifetime = 15 * time.Minute
+	// No 0/O or 1/I, so codes survive being read out.
+	linkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+func init() {
+	commands.NewCommand("link", linkCommand,
+		commands.WithVarArgs(0, 1),
+		commands.WithDescription("Link this account to your Eden account"),
+		commands.WithArgSpec(commands.Arg{Name: "code", Description: "The code .link gave you on your other account"}),
+	)
+	commands.NewCommand("unlink", unlinkCommand,
+		commands.WithVarArgs(0, 1),
+		commands.WithDescription("Unlink this account, or another one, from your Eden account"),
+		commands.WithArgSpec(commands.Arg{Name: "name", Description: "The nick or Discord username to unlink"}),
+	)
+	commands.NewCommand("whoami", whoamiCommand,
+		commands.WithDescription("Show your Eden account and everything linked to it"),
+	)
+}
+
+// A linker is a CommandContext whose users can be linked to Eden accounts.
+type linker interface {
+	// platformIdentity says what we'd store for the user, without checking
+	// that they are who they say.
+	platformIdentity(commands.User) platformIdentity
+	// verifyIdentity checks that the user really is who they say, e.g. with
+	// NickServ.
+	verifyIdentity(commands.User) bool
+}
+
+// A platformIdentity is a row in ircUsers or discordUsers, or one waiting to
+// be.
+type platformIdentity struct {
+	Platform string
+	// The nick on IRC, and the user ID on Discord.
+	Identity string
+	Name     string
+}
+
+func (id platformIdentity) String() string {
+	if id.Platform == "irc" {
+		return "IRC nick " + id.Name
+	}
+	return "Discord user " + id.Name
+}
+
+func linkCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	l, ok := ctx.(linker)
+	if !ok {
+		ctx.SendToUser(msg.Source, "Accounts can't be linked from here.")
+		return
+	}
+	if len(args) == 0 {
+		startLink(ctx, l, msg.Source)
+		return
+	}
+	if err := redeemLink(ctx, l, msg.Source, args[0]); err != nil {
+		ctx.SendToUser(msg.Source, err.Error())
+		return
+	}
+	ctx.SendToUser(msg.Source, "Linked!")
+}
+
+// startLink hands out a code for the user to redeem on their other account.
+func startLink(ctx commands.CommandContext, l linker, source commands.User) {
+	code := models.LinkCode{
+		ExpiresAt: time.Now().Add(linkCodeLifetime),
+	}
+	if user, ok := ctx.Identify(source); ok {
+		code.UserID = &user.ID
+	} else if l.verifyIdentity(source) {
+		id := l.platformIdentity(source)
+		code.Platform = id.Platform
+		code.Identity = id.Identity
+		code.Name = id.Name
+	} else {
+		ctx.SendToUser(source, "I can't tell who you are. On IRC, you need to be identified with NickServ.")
+		return
+	}
+	var err error
+	if code.Code, err = newLinkCode(); err == nil {
+		err = db.Create(&code).Error
+	}
+	if err != nil {
+		log.Printf("Error creating link code: %s\n", err)
+		ctx.SendToUser(source, "Sorry, something went wrong.")
+		return
+	}
+	// Tidy up any codes that were never used.
+	if err := db.Where("expires_at < ?", time.Now()).Delete(models.LinkCode{}).Error; err != nil {
+		log.Printf("Error deleting expired link codes: %s\n", err)
+	}
+	where := fmt.Sprintf("Run %slink %s from your other account", ctx.Prefix(), code.Code)
+	if config.HTTPPublicURL != "" {
+		where += ", or enter it at " + publicURL("/link")
+	}
+	ctx.SendToUser(source, fmt.Sprintf("Your link code is %s. %s, within %d minutes.",
+		code.Code, where, int(linkCodeLifetime.Minutes())))
+}
+
+func newLinkCode() (string, error) {
+	b := make([]byte, linkCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = linkCodeAlphabet[int(b[i])%len(linkCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// redeemLink uses a code from .link. Whichever of the two accounts is
+// already linked decides the Eden user, and the other gets linked to it.
+func redeemLink(ctx commands.CommandContext, l linker, source commands.User, code string) error {
+	var link models.LinkCode
+	if db.Where("code = ? AND expires_at > ?", strings.ToUpper(code), time.Now()).First(&link).RecordNotFound() {
+		return fmt.Errorf("That code is wrong or has expired.")
+	}
+	if link.UserID == nil {
+		user, ok := ctx.Identify(source)
+		if !ok {
+			return fmt.Errorf("Neither account is linked yet. Use the code on the website, or from an account that's already linked.")
+		}
+		_, err := confirmLinkCode(link.Code, user)
+		return err
+	}
+	if _, ok := ctx.Identify(source); ok {
+		return fmt.Errorf("This account is already linked. Use %sunlink first if you want to move it.", ctx.Prefix())
+	}
+	if !l.verifyIdentity(source) {
+		return fmt.Errorf("I can't tell who you are. On IRC, you need to be identified with NickServ.")
+	}
+	if err := linkIdentity(db, l.platformIdentity(source), *link.UserID); err != nil {
+		return err
+	}
+	db.Delete(&link)
+	return nil
+}
+
+// confirmLinkCode links the identity waiting on a code to user, e.g. once
+// they've entered the code on the website, and returns it.
+func confirmLinkCode(code string, user *models.User) (platformIdentity, error) {
+	var link models.LinkCode
+	if db.Where("code = ? AND expires_at > ? AND user_id IS NULL", strings.ToUpper(code), time.Now()).First(&link).RecordNotFound() {
+		return platformIdentity{}, fmt.Errorf("That code is wrong or has expired.")
+	}
+	id := platformIdentity{
+		Platform: link.Platform,
+		Identity: link.Identity,
+		Name:     link.Name,
+	}
+	if err := linkIdentity(db, id, user.ID); err != nil {
+		return id, err
+	}
+	db.Delete(&link)
+	return id, nil
+}
+
+// linkIdentity links id to the user, using tx so that callers can make it
+// part of something bigger.
+func linkIdentity(tx *gorm.DB, id platformIdentity, userID uint) error {
+	var err error
+	switch id.Platform {
+	case "irc":
+		ircUser := models.IrcUser{Nickname: id.Identity}
+		if !tx.Where(&ircUser).First(&ircUser).RecordNotFound() {
+			return fmt.Errorf("%s is already linked to an account.", id)
+		}
+		ircUser.UserID = userID
+		err = tx.Create(&ircUser).Error
+	case "discord":
+		discordUser := models.DiscordUser{DiscordID: id.Identity}
+		if !tx.Where(&discordUser).First(&discordUser).RecordNotFound() {
+			return fmt.Errorf("%s is already linked to an account.", id)
+		}
+		discordUser.Name = id.Name
+		discordUser.UserID = userID
+		err = tx.Create(&discordUser).Error
+	default:
+		return fmt.Errorf("I don't know how to link %s accounts.", id.Platform)
+	}
+	if err != nil {
+		log.Printf("Error linking %s: %s\n", id, err)
+		return fmt.Errorf("Sorry, something went wrong.")
+	}
+	forgetIdentity(id)
+	return nil
+}
+
+func unlinkIdentity(tx *gorm.DB, id platformIdentity, userID uint) error {
+	var query = tx.Where("user_id = ?", userID)
+	switch id.Platform {
+	case "irc":
+		query = query.Where("nickname = ?", id.Identity).Delete(models.IrcUser{})
+	case "discord":
+		query = query.Where("discord_id = ?", id.Identity).Delete(models.DiscordUser{})
+	}
+	if query.Error != nil {
+		log.Printf("Error unlinking %s: %s\n", id, query.Error)
+		return fmt.Errorf("Sorry, something went wrong.")
+	}
+	if query.RowsAffected == 0 {
+		return fmt.Errorf("%s isn't linked to your account.", id)
+	}
+	forgetIdentity(id)
+	return nil
+}
+
+// forgetIdentity clears whatever the connections have cached about who an
+// identity belongs to.
+func forgetIdentity(id platformIdentity) {
+	for _, conn := range connections.Connections() {
+		switch conn := conn.(type) {
+		case *IrcConn:
+			if id.Platform == "irc" {
+				conn.users.remove(id.Identity)
+			}
+		case *DiscordConn:
+			if id.Platform == "discord" {
+				conn.forgetPermissions(id.Identity)
+			}
+		}
+	}
+}
+
+// linkedIdentities lists the IRC nicks and Discord accounts linked to user.
+func linkedIdentities(user *models.User) ([]platformIdentity, error) {
+	var ircUsers []models.IrcUser
+	if err := db.Where("user_id = ?", user.ID).Order("nickname").Find(&ircUsers).Error; err != nil {
+		return nil, err
+	}
+	var discordUsers []models.DiscordUser
+	if err := db.Where("user_id = ?", user.ID).Order("name").Find(&discordUsers).Error; err != nil {
+		return nil, err
+	}
+	var ids []platformIdentity
+	for _, u := range ircUsers {
+		ids = append(ids, platformIdentity{Platform: "irc", Identity: u.Nickname, Name: u.Nickname})
+	}
+	for _, u := range discordUsers {
+		ids = append(ids, platformIdentity{Platform: "discord", Identity: u.DiscordID, Name: u.Name})
+	}
+	return ids, nil
+}
+
+func unlinkCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	l, ok := ctx.(linker)
+	user, identified := ctx.Identify(msg.Source)
+	if !ok || !identified {
+		ctx.SendToUser(msg.Source, "This account isn't linked to anything.")
+		return
+	}
+	id := l.platformIdentity(msg.Source)
+	if len(args) > 0 {
+		ids, err := linkedIdentities(user)
+		if err != nil {
+			log.Printf("Error fetching linked identities: %s\n", err)
+		}
+		found := false
+		for _, linked := range ids {
+			if strings.EqualFold(linked.Name, args[0]) {
+				id, found = linked, true
+				break
+			}
+		}
+		if !found {
+			ctx.SendToUser(msg.Source, fmt.Sprintf("Nothing called %s is linked to your account.", args[0]))
+			return
+		}
+	}
+	if err := unlinkIdentity(db, id, user.ID); err != nil {
+		ctx.SendToUser(msg.Source, err.Error())
+		return
+	}
+	ctx.SendToUser(msg.Source, fmt.Sprintf("Unlinked %s.", id))
+}
+
+func whoamiCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	user, ok := ctx.Identify(msg.Source)
+	if !ok {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("You're not linked to an Eden account. Use %slink to link one.", ctx.Prefix()))
+		return
+	}
+	ids, err := linkedIdentities(user)
+	if err != nil {
+		log.Printf("Error fetching linked identities: %s\n", err)
+	}
+	var nicks, discord []string
+	for _, id := range ids {
+		if id.Platform == "irc" {
+			nicks = append(nicks, id.Name)
+		} else {
+			discord = append(discord, id.Name)
+		}
+	}
+	text := fmt.Sprintf("You're %s on Eden.", user.Username)
+	if len(nicks) > 0 {
+		text += " IRC: " + strings.Join(nicks, ", ") + "."
+	}
+	if len(discord) > 0 {
+		text += " Discord: " + strings.Join(discord, ", ") + "."
+	}
+	ctx.SendToUser(msg.Source, text)
+}
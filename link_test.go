@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/erikstmartin/go-testdb"
+	"github.com/santiclause/eden/models"
+)
+
+func TestLinkAccount(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   string
+		status int
+		linked bool
+		want   string
+	}{
+		{
+			name:   "good code",
+			code:   " abcd2345 ",
+			status: http.StatusOK,
+			linked: true,
+			want:   "Linked IRC nick Somebody.",
+		},
+		{
+			name:   "wrong code",
+			code:   "WXYZ2345",
+			status: http.StatusBadRequest,
+			want:   "That code is wrong or has expired.",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var inserted []driver.Value
+			withTestDB(t, func(query string, args []driver.Value) (driver.Rows, error) {
+				if strings.Contains(query, "linkCodes") && args[0] == "ABCD2345" {
+					return testdb.RowsFromCSVString([]string{"id", "code", "platform", "identity", "name"},
+						"1,ABCD2345,irc,somebody,Somebody"), nil
+				}
+				return testdb.RowsFromCSVString([]string{"id"}, ""), nil
+			})
+			testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (driver.Result, error) {
+				if strings.Contains(query, "INSERT INTO") && strings.Contains(query, "ircUsers") {
+					inserted = args
+				}
+				return testdb.NewResult(1, nil, 1, nil), nil
+			})
+
+			session := &models.Session{UserID: 7, User: models.User{ID: 7, Username: "someone"}}
+			form := url.Values{"code": {test.code}}
+			r := httptest.NewRequest(http.MethodPost, "/link", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = r.WithContext(context.WithValue(r.Context(), sessionKey, session))
+			w := httptest.NewRecorder()
+			linkAccount(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if !strings.Contains(w.Body.String(), test.want) {
+				t.Errorf("page doesn't say %q:\n%s", test.want, w.Body)
+			}
+			if !test.linked {
+				if inserted != nil {
+					t.Errorf("linked %v, want nothing", inserted)
+				}
+				return
+			}
+			var linkedTo bool
+			for _, arg := range inserted {
+				if arg == int64(7) {
+					linkedTo = true
+				}
+			}
+			if !linkedTo {
+				t.Errorf("inserted %v, want it linked to user 7", inserted)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
+// Eden builds without a go.mod, which would otherwise get it Go 1.20's
+// defaults, and the web routes need Go 1.22's method and wildcard patterns.
+//go:debug httpmuxgo121=0
+
 package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/DavidHuie/gomigrate"
@@ -19,7 +24,10 @@ type Config struct {
 	DSN                string        `env:"MYSQL_DSN" yaml:"mysql_dsn"`
 	MigrationsLocation string        `env:"MIGRATIONS_LOCATION" yaml:"migrations_location"`
 	DiscordAuthToken   string        `env:"DISCORD_AUTH_TOKEN" yaml:"discord_auth_token"`
+	DiscordPrefix      string        `env:"DISCORD_PREFIX" yaml:"discord_prefix"`
+	DiscordCommands    []string      `env:"DISCORD_COMMANDS" yaml:"discord_commands"`
 	Version            string        `env:"VERSION" yaml:"version"`
+	IrcNetworks        []IrcNetwork  `yaml:"irc_networks"`
 	IrcServers         []string      `env:"IRC_SERVERS" yaml:"irc_servers"`
 	IrcChannels        []string      `env:"IRC_CHANNELS" yaml:"irc_channels"`
 	IrcNickname        string        `env:"IRC_NICKNAME" yaml:"irc_nickname"`
@@ -28,21 +36,139 @@ type Config struct {
 	IrcNickservPass    string        `env:"IRC_NICKSERV_PASS" yaml:"irc_nickserv_pass"`
 	IrcNickservTimeout time.Duration `env:"IRC_NICKSERV_TIMEOUT" yaml:"irc_nickserv_timeout"`
 	IrcQuitMessage     string        `env:"IRC_QUIT_MESSAGE" yaml:"irc_quit_message"`
+	// How long to keep IRC channel logs for. Zero keeps them forever.
+	IrcLogRetention time.Duration `env:"IRC_LOG_RETENTION" yaml:"irc_log_retention"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" yaml:"shutdown_timeout"`
+	// Icecast's status-json.xsl, and the mount to watch if there's more than one.
+	StreamStatusURL    string        `env:"STREAM_STATUS_URL" yaml:"stream_status_url"`
+	StreamMount        string        `env:"STREAM_MOUNT" yaml:"stream_mount"`
+	StreamPollInterval time.Duration `env:"STREAM_POLL_INTERVAL" yaml:"stream_poll_interval"`
+	PasteURL           string        `env:"PASTE_URL" yaml:"paste_url"`
+	PasteField         string        `env:"PASTE_FIELD" yaml:"paste_field"`
+	// Where to find Eden's source, for CTCP SOURCE.
+	SourceURL string `env:"SOURCE_URL" yaml:"source_url"`
+	// Discord role IDs to the Eden roles or permissions they grant. Names
+	// aren't accepted, since any guild we're in can make a role by any name.
+	DiscordRoles map[string]string `yaml:"discord_roles"`
+	// The voice channel ID to play the radio in, and the Ogg/Opus stream or
+	// file to play. When nobody's listening we either "pause" or "leave".
+	DiscordVoiceChannel   string `env:"DISCORD_VOICE_CHANNEL" yaml:"discord_voice_channel"`
+	DiscordVoiceSource    string `env:"DISCORD_VOICE_SOURCE" yaml:"discord_voice_source"`
+	DiscordVoiceWhenAlone string `env:"DISCORD_VOICE_WHEN_ALONE" yaml:"discord_voice_when_alone"`
+	// A channel ID whose topic follows the radio, rendered from a
+	// text/template of NowPlaying. Discord won't let us change it more than
+	// twice every ten minutes.
+	DiscordTopicChannel  string        `env:"DISCORD_TOPIC_CHANNEL" yaml:"discord_topic_channel"`
+	DiscordTopicTemplate string        `env:"DISCORD_TOPIC_TEMPLATE" yaml:"discord_topic_template"`
+	DiscordTopicInterval time.Duration `env:"DISCORD_TOPIC_INTERVAL" yaml:"discord_topic_interval"`
+	// Where the website and API listen, e.g. ":8080". Empty turns them off.
+	HTTPListen string `env:"HTTP_LISTEN" yaml:"http_listen"`
+	// Origins allowed to use the API from the browser, or "*" for any.
+	HTTPCORSOrigins []string `env:"HTTP_CORS_ORIGINS" yaml:"http_cors_origins"`
+	// Where people reach the website, for links we send them.
+	HTTPPublicURL string `env:"HTTP_PUBLIC_URL" yaml:"http_public_url"`
+	// Turn off for testing over plain HTTP, so the browser keeps our cookies.
+	HTTPSecureCookies bool `env:"HTTP_SECURE_COOKIES" yaml:"http_secure_cookies"`
+	// Trust X-Forwarded-For, when there's a reverse proxy in front of us.
+	HTTPBehindProxy bool          `env:"HTTP_BEHIND_PROXY" yaml:"http_behind_proxy"`
+	SessionLifetime time.Duration `env:"SESSION_LIFETIME" yaml:"session_lifetime"`
+	// Where uploads wait for a moderator, and where approved songs go.
+	UploadDir         string        `env:"UPLOAD_DIR" yaml:"upload_dir"`
+	LibraryDir        string        `env:"LIBRARY_DIR" yaml:"library_dir"`
+	UploadMaxSize     int64         `env:"UPLOAD_MAX_SIZE" yaml:"upload_max_size"`
+	UploadMaxDuration time.Duration `env:"UPLOAD_MAX_DURATION" yaml:"upload_max_duration"`
+	// How long someone waits between requests, and how long a song has to
+	// go unplayed before it can be requested again.
+	RequestUserCooldown time.Duration `env:"REQUEST_USER_COOLDOWN" yaml:"request_user_cooldown"`
+	RequestSongCooldown time.Duration `env:"REQUEST_SONG_COOLDOWN" yaml:"request_song_cooldown"`
+	RequestQueueSize    int           `env:"REQUEST_QUEUE_SIZE" yaml:"request_queue_size"`
+	// What the playback backend sends as a bearer token to take requests
+	// off the queue. Empty turns that off.
+	RequestBackendToken string `env:"REQUEST_BACKEND_TOKEN" yaml:"request_backend_token"`
+	// How often the play history is rolled up for the stats, which lag
+	// behind by up to this long.
+	StatsRefreshInterval time.Duration `env:"STATS_REFRESH_INTERVAL" yaml:"stats_refresh_interval"`
 	goconfig.Config
 }
 
 var (
-	config = Config{
-		MigrationsLocation: "migrations",
-		IrcNickservTimeout: 15 * time.Second,
-	}
-	db *gorm.DB
+	config      = defaultConfig()
+	db          *gorm.DB
+	connections = NewConnectionManager()
 )
 
+// defaultConfig is the config before the file and environment have their
+// say.
+func defaultConfig() Config {
+	return Config{
+		MigrationsLocation:    "migrations",
+		IrcNickservTimeout:    15 * time.Second,
+		ShutdownTimeout:       15 * time.Second,
+		StreamPollInterval:    5 * time.Second,
+		PasteField:            "sprunge",
+		SourceURL:             "https://github.com/santiclause/eden",
+		DiscordVoiceWhenAlone: "pause",
+		HTTPSecureCookies:     true,
+		SessionLifetime:       30 * 24 * time.Hour,
+		UploadDir:             "uploads",
+		LibraryDir:            "library",
+		UploadMaxSize:         200 << 20,
+		UploadMaxDuration:     20 * time.Minute,
+		RequestUserCooldown:   20 * time.Minute,
+		RequestSongCooldown:   3 * time.Hour,
+		RequestQueueSize:      20,
+		StatsRefreshInterval:  10 * time.Minute,
+	}
+}
+
+// Networks returns the configured IRC network blocks, with any settings they
+// leave empty filled in from the top-level IRC settings. If there are no
+// network blocks, each of the top-level servers is a network of its own.
+func (c *Config) Networks() []IrcNetwork {
+	networks := c.IrcNetworks
+	if len(networks) == 0 {
+		// The old settings connect to every server, not just the first that
+		// answers, so each one is its own network.
+		for _, server := range c.IrcServers {
+			networks = append(networks, IrcNetwork{
+				Name:         server,
+				Servers:      []string{server},
+				Channels:     c.IrcChannels,
+				NickservPass: c.IrcNickservPass,
+			})
+		}
+	}
+	result := make([]IrcNetwork, len(networks))
+	for i, network := range networks {
+		if network.Name == "" {
+			network.Name = fmt.Sprintf("network%d", i)
+		}
+		if network.Nickname == "" {
+			network.Nickname = c.IrcNickname
+		}
+		if network.Ident == "" {
+			network.Ident = c.IrcIdent
+		}
+		if network.RealName == "" {
+			network.RealName = c.IrcName
+		}
+		if network.NickservTimeout == 0 {
+			network.NickservTimeout = c.IrcNickservTimeout
+		}
+		if network.QuitMessage == "" {
+			network.QuitMessage = c.IrcQuitMessage
+		}
+		result[i] = network
+	}
+	return result
+}
+
 func main() {
+	exportLogs := flag.String("export-logs", "", "write the IRC logs to text files in this directory and exit")
+	flag.Parse()
+
 	config.SetFilename("config.yaml")
 	goconfig.Load(&config)
-	goconfig.ListenForSignals(&config)
 	migrationDB, err := sql.Open("mysql", config.DSN)
 	if err != nil {
 		log.Fatal(err)
@@ -65,52 +191,84 @@ func main() {
 		db.LogMode(true)
 	}
 
+	if *exportLogs != "" {
+		if err := exportIrcLogs(*exportLogs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	fmt.Println("Hello!")
-	fmt.Printf("List of servers: %v\n", config.IrcServers)
-	fmt.Printf("List of channels: %v\n", config.IrcChannels)
-
-	var servers []*IrcConn
-	for _, server := range config.IrcServers {
-		conn, err := Connect(
-			server,
-			config.IrcNickname,
-			WithAutojoinChannels(config.IrcChannels),
-			WithIdent(config.IrcIdent),
-			WithName(config.IrcName),
-			WithNickservPassword(config.IrcNickservPass),
-			WithNickservTimeout(config.IrcNickservTimeout),
-			WithVersion(config.Version),
-			WithQuitMessage(config.IrcQuitMessage),
+	startIrcLogging()
+	startSeen()
+	startTells()
+	startStats()
+
+	if config.HTTPListen != "" {
+		startWebServer()
+	}
+
+	if config.StreamStatusURL != "" {
+		go watchStream(config.StreamStatusURL, config.StreamMount, config.StreamPollInterval)
+	}
+
+	for _, network := range config.Networks() {
+		fmt.Printf("%s: servers %v, channels %v\n", network.Name, network.Servers, network.Channels)
+		conn, err := network.NewConn()
+		if err == nil {
+			err = connections.Add(conn)
+		}
+		if err != nil {
+			log.Printf("Shit's fucked, failed to set up %s. %s\n", network.Name, err)
+		}
+	}
+	if config.DiscordAuthToken != "" {
+		conn, err := NewDiscordConn(
+			config.DiscordAuthToken,
+			WithDiscordCommandPrefix(config.DiscordPrefix),
+			WithDiscordEnabledCommands(config.DiscordCommands),
+			WithDiscordRoles(config.DiscordRoles),
+			WithDiscordVoice(voiceSettings{
+				Channel:   config.DiscordVoiceChannel,
+				Source:    config.DiscordVoiceSource,
+				WhenAlone: config.DiscordVoiceWhenAlone,
+			}),
+			WithDiscordTopic(topicSettings{
+				Channel:  config.DiscordTopicChannel,
+				Template: config.DiscordTopicTemplate,
+				Interval: config.DiscordTopicInterval,
+			}),
 		)
 		if err == nil {
-			servers = append(servers, conn)
-		} else {
-			log.Printf("Shit's fucked, failed to connect. %s\n", err)
+			err = connections.Add(conn)
+		}
+		if err != nil {
+			log.Printf("Shit's fucked, failed to set up Discord. %s\n", err)
 		}
 	}
 
+	// We handle SIGHUP ourselves rather than with goconfig.ListenForSignals,
+	// so that the connections can react to the new config.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloadConfig()
+		}
+	}()
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 
 	<-sig
-	wait := sync.WaitGroup{}
 	fmt.Println("Closing...")
-	for _, server := range servers {
-		if !server.conn.Connected() {
-			continue
-		}
-		wait.Add(1)
-		go (func() {
-			timeout := time.After(15 * time.Second)
-			select {
-			case <-server.Close():
-				wait.Done()
-			case <-timeout:
-				wait.Done()
-			}
-		})()
-	}
-	wait.Wait()
+	done := make(chan struct{})
+	go func() {
+		stopWebServer(config.ShutdownTimeout)
+		close(done)
+	}()
+	connections.Shutdown(config.ShutdownTimeout)
+	<-done
 	fmt.Println("Goodbye!")
 
 	// var user models.User
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS auditLog (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `user_id` bigint,
+    `action` varchar(60) NOT NULL,
+    `target` varchar(191) NOT NULL DEFAULT '',
+    `detail` text NOT NULL,
+    `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY (`created_at`),
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE SET NULL
+);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE name = 'moderate';
+DROP TABLE IF EXISTS uploads;
+ALTER TABLE songs DROP INDEX `hash`, DROP COLUMN `hash`, DROP COLUMN `duration`, DROP COLUMN `album`;
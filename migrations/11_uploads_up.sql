@@ -0,0 +1,26 @@
+ALTER TABLE songs ADD COLUMN `album` varchar(191) NOT NULL DEFAULT '', ADD COLUMN `duration` int NOT NULL DEFAULT 0, ADD COLUMN `hash` char(64) CHARACTER SET latin1 COLLATE latin1_bin, ADD UNIQUE KEY `hash` (`hash`);
+CREATE TABLE IF NOT EXISTS uploads (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `user_id` bigint NOT NULL,
+    `filename` varchar(191) NOT NULL,
+    `original_name` varchar(191) NOT NULL DEFAULT '',
+    `format` varchar(10) NOT NULL,
+    `title` varchar(191) NOT NULL DEFAULT '',
+    `artist` varchar(191) NOT NULL DEFAULT '',
+    `album` varchar(191) NOT NULL DEFAULT '',
+    `duration` int NOT NULL DEFAULT 0,
+    `size` bigint NOT NULL DEFAULT 0,
+    `hash` char(64) CHARACTER SET latin1 COLLATE latin1_bin NOT NULL,
+    `status` varchar(20) NOT NULL DEFAULT 'pending',
+    `reviewer_id` bigint,
+    `reviewed_at` timestamp NULL,
+    `song_id` bigint,
+    `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY (`status`),
+    KEY (`hash`),
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (`reviewer_id`) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (`song_id`) REFERENCES songs(id) ON DELETE SET NULL
+);
+INSERT INTO permissions (name) VALUES ('moderate');
+INSERT INTO role_permissions (role_id, permission_id) SELECT rp.role_id, (SELECT id FROM permissions WHERE name = 'moderate') FROM role_permissions rp JOIN permissions p ON p.id = rp.permission_id WHERE p.name = 'super';
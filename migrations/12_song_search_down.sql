@@ -0,0 +1,2 @@
+ALTER TABLE artists DROP INDEX `name_search`;
+ALTER TABLE songs DROP INDEX `title_search`;
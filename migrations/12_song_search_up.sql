@@ -0,0 +1,2 @@
+ALTER TABLE songs ADD FULLTEXT KEY `title_search` (`title`);
+ALTER TABLE artists ADD FULLTEXT KEY `name_search` (`name`);
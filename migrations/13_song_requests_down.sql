@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS songRequests;
+ALTER TABLE songs DROP COLUMN `quarantined`;
@@ -0,0 +1,13 @@
+ALTER TABLE songs ADD COLUMN `quarantined` boolean NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS songRequests (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `song_id` bigint NOT NULL,
+    `user_id` bigint NOT NULL,
+    `status` varchar(20) NOT NULL DEFAULT 'queued',
+    `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `picked_at` timestamp NULL,
+    KEY (`status`, `created_at`),
+    KEY (`user_id`, `created_at`),
+    FOREIGN KEY (`song_id`) REFERENCES songs(id) ON DELETE CASCADE,
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE CASCADE
+);
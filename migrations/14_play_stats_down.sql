@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS statsRollups;
+DROP TABLE IF EXISTS djSessions;
+DROP TABLE IF EXISTS playStatsHourly;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS playStatsHourly (
+    `day` date NOT NULL,
+    `hour` tinyint NOT NULL,
+    `song_id` bigint NOT NULL,
+    `dj` bigint NOT NULL,
+    `plays` int NOT NULL,
+    PRIMARY KEY (`day`, `hour`, `song_id`, `dj`),
+    KEY (`song_id`),
+    KEY (`dj`, `day`)
+);
+CREATE TABLE IF NOT EXISTS djSessions (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `dj` bigint NOT NULL,
+    `started` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `ended` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `plays` int NOT NULL DEFAULT 0,
+    KEY (`started`),
+    KEY (`dj`, `started`)
+);
+CREATE TABLE IF NOT EXISTS statsRollups (
+    `name` varchar(60) PRIMARY KEY,
+    `last_id` bigint NOT NULL DEFAULT 0
+);
+INSERT INTO statsRollups (name) VALUES ('plays');
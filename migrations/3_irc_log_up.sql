@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS ircLog (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `network` varchar(60) NOT NULL,
+    `channel` varchar(60) NOT NULL,
+    `nick` varchar(60) NOT NULL,
+    `account` varchar(60),
+    `type` ENUM('PRIVMSG', 'NOTICE', 'ACTION', 'JOIN', 'PART', 'QUIT', 'KICK', 'NICK', 'TOPIC') NOT NULL,
+    `target` varchar(60),
+    `text` text NOT NULL,
+    `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY (`network`, `channel`, `timestamp`),
+    KEY (`nick`, `timestamp`),
+    KEY (`timestamp`)
+);
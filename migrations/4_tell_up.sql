@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS tells (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `sender` varchar(60) NOT NULL,
+    `recipient` varchar(60) NOT NULL,
+    `recipient_id` bigint,
+    `message` text NOT NULL,
+    `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `delivered_at` timestamp NULL,
+    KEY (`recipient`, `delivered_at`),
+    KEY (`recipient_id`, `delivered_at`),
+    FOREIGN KEY (`recipient_id`) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS seen (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `connection` varchar(60) NOT NULL,
+    `identity` varchar(60) NOT NULL,
+    `name` varchar(60) NOT NULL,
+    `channel` varchar(100) NOT NULL,
+    `text` text NOT NULL,
+    `seen_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (`connection`, `identity`),
+    KEY (`name`)
+);
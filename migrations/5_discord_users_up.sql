@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS discordUsers (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `user_id` bigint NOT NULL,
+    `discord_id` varchar(20) NOT NULL,
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE KEY (`discord_id`)
+);
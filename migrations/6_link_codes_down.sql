@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS linkCodes;
+ALTER TABLE discordUsers DROP COLUMN `name`;
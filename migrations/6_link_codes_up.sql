@@ -0,0 +1,12 @@
+ALTER TABLE discordUsers ADD COLUMN `name` varchar(60) NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS linkCodes (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `code` varchar(16) NOT NULL,
+    `user_id` bigint,
+    `platform` varchar(20) NOT NULL DEFAULT '',
+    `identity` varchar(60) NOT NULL DEFAULT '',
+    `name` varchar(60) NOT NULL DEFAULT '',
+    `expires_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (`code`),
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `token` char(64) CHARACTER SET latin1 COLLATE latin1_bin NOT NULL,
+    `csrf_token` char(64) CHARACTER SET latin1 COLLATE latin1_bin NOT NULL,
+    `user_id` bigint NOT NULL,
+    `ip` varchar(45) NOT NULL DEFAULT '',
+    `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `expires_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (`token`),
+    KEY (`expires_at`),
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS passwordResets;
+ALTER TABLE users DROP INDEX `username`;
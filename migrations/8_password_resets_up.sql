@@ -0,0 +1,9 @@
+ALTER TABLE users ADD UNIQUE KEY `username` (`username`);
+CREATE TABLE IF NOT EXISTS passwordResets (
+    `id` bigint PRIMARY KEY AUTO_INCREMENT,
+    `token` char(64) CHARACTER SET latin1 COLLATE latin1_bin NOT NULL,
+    `user_id` bigint NOT NULL,
+    `expires_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (`token`),
+    FOREIGN KEY (`user_id`) REFERENCES users(id) ON DELETE CASCADE
+);
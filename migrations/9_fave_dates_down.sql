@@ -0,0 +1 @@
+ALTER TABLE faves DROP COLUMN `created_at`;
@@ -0,0 +1 @@
+ALTER TABLE faves ADD COLUMN `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP;
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// An AuditLog entry records a change someone made through the admin pages.
+// UserID is who made it, and is nil if they've since been deleted.
+type AuditLog struct {
+	ID        uint `gorm:"primary_key"`
+	User      User
+	UserID    *uint
+	Action    string
+	Target    string
+	Detail    string
+	CreatedAt time.Time
+}
+
+func (AuditLog) TableName() string {
+	return "auditLog"
+}
@@ -0,0 +1,15 @@
+package models
+
+type DiscordUser struct {
+	ID        uint   `gorm:"primary_key"`
+	DiscordID string `gorm:"size:20"`
+	// The Discord username when they linked, since the ID means nothing to
+	// people.
+	Name   string `gorm:"size:60"`
+	User   User
+	UserID uint
+}
+
+func (DiscordUser) TableName() string {
+	return "discordUsers"
+}
@@ -6,3 +6,7 @@ type IrcUser struct {
 	User     User
 	UserID   uint
 }
+
+func (IrcUser) TableName() string {
+	return "ircUsers"
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// IrcLog is a single line of channel activity. Quits and nick changes aren't
+// tied to a channel, so they're logged with an empty Channel.
+type IrcLog struct {
+	ID      uint   `gorm:"primary_key"`
+	Network string `gorm:"size:60"`
+	Channel string `gorm:"size:60"`
+	Nick    string `gorm:"size:60"`
+	// The Eden username of the nick, if we know it.
+	Account string `gorm:"size:60"`
+	Type    string
+	// The other nick involved, i.e. the new nick for NICK and the kicked nick
+	// for KICK.
+	Target    string `gorm:"size:60"`
+	Text      string
+	Timestamp time.Time
+}
+
+func (IrcLog) TableName() string {
+	return "ircLog"
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// A LinkCode is handed out by .link, and ties two identities together when
+// it's redeemed. If UserID is set it came from someone who's already linked,
+// otherwise it carries the platform identity that wants linking.
+type LinkCode struct {
+	ID        uint `gorm:"primary_key"`
+	Code      string
+	UserID    *uint
+	Platform  string
+	Identity  string
+	Name      string
+	ExpiresAt time.Time
+}
+
+func (LinkCode) TableName() string {
+	return "linkCodes"
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+const (
+	RequestQueued = "queued"
+	// The playback backend has taken it off the queue.
+	RequestPicked = "picked"
+)
+
+// A SongRequest is a listener asking for a song to be played.
+type SongRequest struct {
+	ID        uint `gorm:"primary_key"`
+	Song      Song
+	SongID    uint
+	User      User
+	UserID    uint
+	Status    string
+	CreatedAt time.Time
+	PickedAt  *time.Time
+}
+
+func (SongRequest) TableName() string {
+	return "songRequests"
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// A Session is someone logged in to the website. Token is the SHA-256 of the
+// cookie, so the table alone can't be used to log in.
+type Session struct {
+	ID        uint `gorm:"primary_key"`
+	Token     string
+	CSRFToken string `gorm:"column:csrf_token"`
+	User      User
+	UserID    uint
+	IP        string `gorm:"column:ip"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// A PasswordReset lets someone who's proved who they are on IRC or Discord
+// set a new password. Token is the SHA-256 of the one in the link.
+type PasswordReset struct {
+	ID        uint `gorm:"primary_key"`
+	Token     string
+	User      User
+	UserID    uint
+	ExpiresAt time.Time
+}
+
+func (PasswordReset) TableName() string {
+	return "passwordResets"
+}
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+type Artist struct {
+	ID    uint   `gorm:"primary_key"`
+	Name  string `gorm:"size:191"`
+	Songs []Song
+}
+
+type Song struct {
+	ID       uint   `gorm:"primary_key"`
+	Filename string `gorm:"size:191"`
+	Title    string `gorm:"size:191"`
+	Artist   Artist
+	ArtistID uint
+	Album    string `gorm:"size:191"`
+	// In seconds, or 0 if we don't know.
+	Duration uint
+	// The SHA-256 of the audio, for songs that were uploaded.
+	Hash *string
+	// Quarantined songs stay in the library but can't be requested.
+	Quarantined bool
+}
+
+// A Fave is a song someone's favourited.
+type Fave struct {
+	UserID    uint `gorm:"primary_key"`
+	Song      Song
+	SongID    uint `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+// PlayHistory is a song being played on the radio. DJ is the user ID of
+// whoever was on air.
+type PlayHistory struct {
+	ID     uint `gorm:"primary_key"`
+	Song   Song
+	SongID uint
+	DJ     uint `gorm:"column:dj"`
+	Played time.Time
+}
+
+func (PlayHistory) TableName() string {
+	return "playHistory"
+}
+
+// A DJSession is a run of songs played by one DJ, rolled up from
+// playHistory.
+type DJSession struct {
+	ID      uint `gorm:"primary_key"`
+	DJ      uint `gorm:"column:dj"`
+	Started time.Time
+	// When the last song finished, if we know how long it was.
+	Ended time.Time
+	Plays int
+}
+
+func (DJSession) TableName() string {
+	return "djSessions"
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// A Tell is a note left for someone with .tell. If the recipient could be
+// resolved to an Eden user, RecipientID is set and it's delivered to them on
+// whichever platform they turn up on; otherwise it goes to whoever next uses
+// the Recipient name.
+type Tell struct {
+	ID          uint `gorm:"primary_key"`
+	Sender      string
+	Recipient   string
+	RecipientID *uint
+	Message     string
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+}
+
+// Seen is the last thing someone said in a channel on a connection.
+type Seen struct {
+	ID         uint `gorm:"primary_key"`
+	Connection string
+	// Lowercased nick on IRC, user ID on Discord.
+	Identity string
+	Name     string
+	Channel  string
+	Text     string
+	SeenAt   time.Time
+}
+
+func (Seen) TableName() string {
+	return "seen"
+}
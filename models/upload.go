@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+const (
+	UploadPending  = "pending"
+	UploadApproved = "approved"
+	UploadRejected = "rejected"
+)
+
+// An Upload is a song someone's uploaded, waiting for a moderator to approve
+// it into the library. Filename is where it's kept until then.
+type Upload struct {
+	ID           uint `gorm:"primary_key"`
+	User         User
+	UserID       uint
+	Filename     string
+	OriginalName string
+	Format       string
+	Title        string
+	Artist       string
+	Album        string
+	// In seconds.
+	Duration   uint
+	Size       int64
+	Hash       string
+	Status     string
+	Reviewer   User
+	ReviewerID *uint
+	ReviewedAt *time.Time
+	SongID     *uint
+	CreatedAt  time.Time
+}
@@ -30,3 +30,11 @@ type Permission struct {
 func (user *User) GetPermissions(db *gorm.DB) error {
 	return db.Joins("JOIN role_permissions ON permissions.id = role_permissions.permission_id").Joins("JOIN user_roles USING (role_id)").Where("user_id = ?", user.ID).Find(&user.Permissions).Error
 }
+
+// PermissionsByName finds the permissions with the given names, along with
+// the permissions of any roles with the given names.
+func PermissionsByName(db *gorm.DB, names []string) ([]Permission, error) {
+	var permissions []Permission
+	err := db.Where("name IN (?)", names).Or("id IN (SELECT permission_id FROM role_permissions JOIN roles ON roles.id = role_permissions.role_id WHERE roles.name IN (?))", names).Find(&permissions).Error
+	return permissions, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// oggReader pulls Opus packets out of an Ogg stream, which is what Icecast
+// serves an Opus mount as. Discord wants the Opus packets as they are, so we
+// don't need to decode anything.
+type oggReader struct {
+	r       *bufio.Reader
+	packets [][]byte
+	// A packet that carries on into the next page.
+	partial []byte
+	// Keep every packet, headers included, e.g. to read the tags.
+	keepHeaders bool
+	// The granule position of the last page that had one, which counts
+	// samples.
+	granule int64
+}
+
+func newOggReader(r io.Reader) *oggReader {
+	return &oggReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// ReadPacket returns the next Opus audio packet. The OpusHead and OpusTags
+// headers are skipped, including the ones that come round again when a
+// chained stream moves on to the next song.
+func (o *oggReader) ReadPacket() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+func (o *oggReader) readPage() error {
+	var header [27]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return fmt.Errorf("not an Ogg stream")
+	}
+	// -1 means no packet finishes on this page.
+	if granule := int64(binary.LittleEndian.Uint64(header[6:14])); granule != -1 {
+		o.granule = granule
+	}
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, segments); err != nil {
+		return err
+	}
+	for _, length := range segments {
+		data := make([]byte, length)
+		if _, err := io.ReadFull(o.r, data); err != nil {
+			return err
+		}
+		o.partial = append(o.partial, data...)
+		// A segment shorter than 255 bytes ends the packet.
+		if length < 255 {
+			if o.keepHeaders || !isOpusHeader(o.partial) {
+				o.packets = append(o.packets, o.partial)
+			}
+			o.partial = nil
+		}
+	}
+	return nil
+}
+
+func isOpusHeader(packet []byte) bool {
+	return bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags"))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestOggReader(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 300)
+	head := []byte("OpusHead\x01\x02\x00\x00\x80\xbb\x00\x00\x00\x00\x00")
+	tags := []byte("OpusTags")
+	tests := []struct {
+		name        string
+		stream      []byte
+		keepHeaders bool
+		packets     [][]byte
+		granule     int64
+		wantErr     bool
+	}{
+		{
+			name:    "skips the headers",
+			stream:  concat(oggPage(0, head), oggPage(0, tags), oggPage(960, []byte{1}, []byte{2})),
+			packets: [][]byte{{1}, {2}},
+			granule: 960,
+		},
+		{
+			name:        "keeps the headers if asked",
+			stream:      concat(oggPage(0, head), oggPage(0, tags), oggPage(960, []byte{1})),
+			keepHeaders: true,
+			packets:     [][]byte{head, tags, {1}},
+			granule:     960,
+		},
+		{
+			name:    "packet longer than a segment",
+			stream:  oggPage(960, long, []byte{1}),
+			packets: [][]byte{long, {1}},
+			granule: 960,
+		},
+		{
+			name: "packet carried on to the next page",
+			stream: concat(
+				rawOggPage(-1, []byte{255}, long[:255]),
+				rawOggPage(1920, []byte{45, 1}, append(long[255:], 2)),
+			),
+			packets: [][]byte{long, {2}},
+			granule: 1920,
+		},
+		{
+			name:    "chained stream",
+			stream:  concat(oggPage(0, head), oggPage(0, tags), oggPage(960, []byte{1}), oggPage(0, head), oggPage(0, tags), oggPage(480, []byte{2})),
+			packets: [][]byte{{1}, {2}},
+			granule: 480,
+		},
+		{
+			name:    "not ogg",
+			stream:  bytes.Repeat([]byte("not an ogg page "), 4),
+			wantErr: true,
+		},
+		{
+			name:    "page cut off",
+			stream:  oggPage(960, []byte{1}, long)[:40],
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newOggReader(bytes.NewReader(test.stream))
+			o.keepHeaders = test.keepHeaders
+			var packets [][]byte
+			for {
+				packet, err := o.ReadPacket()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if !test.wantErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				packets = append(packets, packet)
+			}
+			if test.wantErr {
+				t.Fatalf("got %d packets, want an error", len(packets))
+			}
+			if !reflect.DeepEqual(packets, test.packets) {
+				t.Errorf("packets = %v, want %v", packets, test.packets)
+			}
+			if o.granule != test.granule {
+				t.Errorf("granule = %d, want %d", o.granule, test.granule)
+			}
+		})
+	}
+}
+
+// rawOggPage is a page with the given segment table, which lets a packet
+// run on to the next page.
+func rawOggPage(granule int64, segments, data []byte) []byte {
+	b := []byte("OggS\x00\x00")
+	b = binary.LittleEndian.AppendUint64(b, uint64(granule))
+	// Serial number, sequence number and CRC, none of which we check.
+	b = append(b, make([]byte, 12)...)
+	b = append(b, byte(len(segments)))
+	return append(append(b, segments...), data...)
+}
+
+func concat(pages ...[]byte) []byte {
+	return bytes.Join(pages, nil)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var pasteClient = &http.Client{Timeout: 10 * time.Second}
+
+// paste uploads text to the configured sprunge-style paste service, which
+// takes a form post and responds with the URL of the paste.
+func paste(text string) (string, error) {
+	if config.PasteURL == "" {
+		return "", fmt.Errorf("no paste service configured")
+	}
+	resp, err := pasteClient.PostForm(config.PasteURL, url.Values{config.PasteField: {text}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("paste service returned %s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
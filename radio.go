@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/events"
+	"github.com/santiclause/eden/models"
+)
+
+// NowPlaying is what's on the radio right now, according to the stream
+// server.
+type NowPlaying struct {
+	Artist    string
+	Title     string
+	DJ        string
+	Listeners int
+	Peak      int
+	// When the current song started, as far as we know.
+	Since time.Time
+	// Where people are talking about the show, set with .thread.
+	Thread string
+}
+
+func (np NowPlaying) String() string {
+	if np.Artist == "" {
+		return np.Title
+	}
+	return fmt.Sprintf("%s - %s", np.Artist, np.Title)
+}
+
+// Threads are usually a link, but leave room for a few words around it.
+const maxThreadWords = 32
+
+func init() {
+	commands.NewCommand("np", npCommand,
+		commands.WithDescription("What's playing on the radio"),
+	)
+	commands.NewCommand("thread", threadCommand,
+		commands.WithVarArgs(0, maxThreadWords),
+		commands.WithDescription("Show the thread for the show, or set it if you're a DJ"),
+		commands.WithArgSpec(commands.Arg{Name: "thread", Description: "The new thread", Rest: true}),
+	)
+	RegisterCTCP("NP", func(c *IrcConn, nick, arg string) (string, bool) {
+		np := CurrentlyPlaying()
+		if np.Title == "" {
+			return "Nothing's playing right now.", true
+		}
+		return np.String(), true
+	})
+}
+
+var (
+	nowPlaying   NowPlaying
+	nowPlayingMu sync.RWMutex
+)
+
+// CurrentlyPlaying returns a copy of the current radio state.
+func CurrentlyPlaying() NowPlaying {
+	nowPlayingMu.RLock()
+	defer nowPlayingMu.RUnlock()
+	return nowPlaying
+}
+
+// icecastStatus is the bit of Icecast's status-json.xsl that we care about.
+// "source" is an object if there's one mount, and an array if there are more.
+type icecastStatus struct {
+	Icestats struct {
+		Source json.RawMessage `json:"source"`
+	} `json:"icestats"`
+}
+
+type icecastSource struct {
+	ListenURL    string `json:"listenurl"`
+	Artist       string `json:"artist"`
+	Title        string `json:"title"`
+	ServerName   string `json:"server_name"`
+	Listeners    int    `json:"listeners"`
+	ListenerPeak int    `json:"listener_peak"`
+}
+
+var streamClient = &http.Client{Timeout: 10 * time.Second}
+
+func fetchStreamStatus(url, mount string) (*icecastSource, error) {
+	resp, err := streamClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stream status returned %s", resp.Status)
+	}
+	var status icecastStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	var sources []icecastSource
+	if err := json.Unmarshal(status.Icestats.Source, &sources); err != nil {
+		var source icecastSource
+		if err := json.Unmarshal(status.Icestats.Source, &source); err != nil {
+			return nil, fmt.Errorf("no sources in stream status")
+		}
+		sources = append(sources, source)
+	}
+	for i := range sources {
+		if mount == "" || strings.HasSuffix(sources[i].ListenURL, mount) {
+			return &sources[i], nil
+		}
+	}
+	return nil, fmt.Errorf("mount %s not found in stream status", mount)
+}
+
+// watchStream polls the stream server's status and publishes SongChanged,
+// DJChanged and ListenerPeak events as they happen.
+func watchStream(url, mount string, interval time.Duration) {
+	for {
+		source, err := fetchStreamStatus(url, mount)
+		if err != nil {
+			log.Printf("Error fetching stream status: %s\n", err)
+		} else {
+			updateNowPlaying(source)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func updateNowPlaying(source *icecastSource) {
+	artist, title := source.Artist, source.Title
+	// Most source clients only send "Artist - Title" as the title.
+	if artist == "" {
+		if parts := strings.SplitN(title, " - ", 2); len(parts) == 2 {
+			artist, title = parts[0], parts[1]
+		}
+	}
+	now := time.Now()
+
+	nowPlayingMu.Lock()
+	old := nowPlaying
+	nowPlaying.Listeners = source.Listeners
+	listenersChanged := source.Listeners != old.Listeners
+	songChanged := artist != old.Artist || title != old.Title
+	if songChanged {
+		nowPlaying.Artist = artist
+		nowPlaying.Title = title
+		nowPlaying.Since = now
+	}
+	// The DJ's source client sets the stream name.
+	djChanged := source.ServerName != old.DJ
+	nowPlaying.DJ = source.ServerName
+	// On the first poll we just take the server's idea of the peak.
+	first := old.Peak == 0
+	peaked := source.Listeners > old.Peak
+	if first && source.ListenerPeak > source.Listeners {
+		nowPlaying.Peak = source.ListenerPeak
+	} else if peaked {
+		nowPlaying.Peak = source.Listeners
+	}
+	nowPlayingMu.Unlock()
+
+	if songChanged {
+		changed := events.SongChanged{
+			Artist: artist,
+			Title:  title,
+			Time:   now,
+		}
+		if song, ok := findSongByName(artist, title); ok {
+			changed.SongID = song.ID
+		}
+		events.Publish(changed)
+	}
+	if djChanged {
+		events.Publish(events.DJChanged{
+			DJ:   source.ServerName,
+			Time: now,
+		})
+	}
+	if listenersChanged {
+		events.Publish(events.ListenersChanged{
+			Listeners: source.Listeners,
+			Time:      now,
+		})
+	}
+	if peaked && !first {
+		events.Publish(events.ListenerPeak{
+			Listeners: source.Listeners,
+			Time:      now,
+		})
+	}
+}
+
+func setThread(thread string) {
+	nowPlayingMu.Lock()
+	nowPlaying.Thread = thread
+	nowPlayingMu.Unlock()
+	events.Publish(events.ThreadChanged{
+		Thread: thread,
+		Time:   time.Now(),
+	})
+}
+
+func npCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	np := CurrentlyPlaying()
+	if np.Title == "" {
+		reply(ctx, msg, "Nothing's playing right now.")
+		return
+	}
+	text := "Now playing: " + np.String()
+	if np.DJ != "" {
+		text += " | DJ: " + np.DJ
+	}
+	text += fmt.Sprintf(" | Listeners: %d/%d", np.Listeners, np.Peak)
+	reply(ctx, msg, text)
+}
+
+func threadCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	if len(args) == 0 {
+		if thread := CurrentlyPlaying().Thread; thread != "" {
+			reply(ctx, msg, "Thread: "+thread)
+		} else {
+			reply(ctx, msg, "There's no thread right now.")
+		}
+		return
+	}
+	if !ctx.Authorize(msg.Source, models.Permission{Name: "dj"}) {
+		ctx.SendToUser(msg.Source, "Only DJs can set the thread.")
+		return
+	}
+	setThread(strings.Join(args, " "))
+	reply(ctx, msg, "Thread set.")
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/goconfig"
+)
+
+// discordSettings is the part of the config that the Discord connection is
+// built from.
+type discordSettings struct {
+	token    string
+	prefix   string
+	commands []string
+	roles    map[string]string
+	voice    voiceSettings
+	topic    topicSettings
+}
+
+func currentDiscordSettings() discordSettings {
+	return discordSettings{
+		token:    config.DiscordAuthToken,
+		prefix:   config.DiscordPrefix,
+		commands: config.DiscordCommands,
+		roles:    copyRoles(config.DiscordRoles),
+		voice: voiceSettings{
+			Channel:   config.DiscordVoiceChannel,
+			Source:    config.DiscordVoiceSource,
+			WhenAlone: config.DiscordVoiceWhenAlone,
+		},
+		topic: topicSettings{
+			Channel:  config.DiscordTopicChannel,
+			Template: config.DiscordTopicTemplate,
+			Interval: config.DiscordTopicInterval,
+		},
+	}
+}
+
+// reloadConfig reloads the config file and brings the connections in line
+// with it. Connections whose settings haven't changed are left alone. If the
+// new config doesn't load or doesn't make sense, nothing changes.
+func reloadConfig() {
+	fresh := defaultConfig()
+	fresh.SetFilename(config.GetFilename())
+	if err := goconfig.Load(&fresh); err != nil {
+		log.Printf("Error reloading config, keeping the old one: %s\n", err)
+		return
+	}
+	if err := fresh.validate(); err != nil {
+		log.Printf("Error in reloaded config, keeping the old one: %s\n", err)
+		return
+	}
+	oldNetworks := config.Networks()
+	oldDiscord := currentDiscordSettings()
+	config.replace(&fresh)
+	reloadNetworks(oldNetworks, config.Networks())
+	reloadDiscord(oldDiscord, currentDiscordSettings())
+}
+
+// validate catches the mistakes that would otherwise only show up once we're
+// halfway through applying the config.
+func (c *Config) validate() error {
+	names := make(map[string]bool)
+	for _, network := range c.Networks() {
+		if names[network.Name] {
+			return fmt.Errorf("there's more than one network called %s", network.Name)
+		}
+		names[network.Name] = true
+		if len(network.Servers) == 0 {
+			return fmt.Errorf("network %s has no servers", network.Name)
+		}
+	}
+	switch c.DiscordVoiceWhenAlone {
+	case "", "pause", "leave":
+	default:
+		return fmt.Errorf("unknown discord_voice_when_alone %q, want pause or leave", c.DiscordVoiceWhenAlone)
+	}
+	if _, err := parseTopicTemplate(c.DiscordTopicTemplate); err != nil {
+		return fmt.Errorf("bad discord_topic_template: %s", err)
+	}
+	return nil
+}
+
+// replace swaps in every setting from fresh. The goconfig.Config part is
+// ours, lock and all, apart from the debug level.
+func (c *Config) replace(fresh *Config) {
+	c.Lock()
+	defer c.Unlock()
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(fresh).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if !dst.Type().Field(i).Anonymous {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	c.Debug = fresh.Debug
+}
+
+func reloadNetworks(oldNetworks, newNetworks []IrcNetwork) {
+	old := make(map[string]IrcNetwork)
+	for _, network := range oldNetworks {
+		old[network.Name] = network
+	}
+	for _, network := range newNetworks {
+		previous, ok := old[network.Name]
+		delete(old, network.Name)
+		if ok && reflect.DeepEqual(previous, network) {
+			continue
+		}
+		if ok && reflect.DeepEqual(withoutLiveSettings(previous), withoutLiveSettings(network)) {
+			if conn, ok := connections.Get("irc:" + network.Name); ok {
+				log.Printf("Reconfiguring %s\n", network.Name)
+				conn.(*IrcConn).Reconfigure(network)
+				continue
+			}
+		}
+		if ok {
+			log.Printf("Reconnecting to %s\n", network.Name)
+			if err := connections.Remove("irc:"+network.Name, config.ShutdownTimeout); err != nil {
+				log.Printf("Error disconnecting from %s: %s\n", network.Name, err)
+			}
+		} else {
+			log.Printf("Connecting to new network %s\n", network.Name)
+		}
+		conn, err := network.NewConn()
+		if err == nil {
+			err = connections.Add(conn)
+		}
+		if err != nil {
+			log.Printf("Error setting up %s: %s\n", network.Name, err)
+		}
+	}
+	// Whatever's left has been removed from the config.
+	for name := range old {
+		log.Printf("Disconnecting from removed network %s\n", name)
+		if err := connections.Remove("irc:"+name, config.ShutdownTimeout); err != nil {
+			log.Printf("Error disconnecting from %s: %s\n", name, err)
+		}
+	}
+}
+
+// withoutLiveSettings clears the settings that IrcConn.Reconfigure can change
+// on a running connection, so that comparing what's left tells us whether we
+// need to reconnect.
+func withoutLiveSettings(n IrcNetwork) IrcNetwork {
+	n.Channels = nil
+	n.Nickname = ""
+	n.NickservPass = ""
+	n.QuitMessage = ""
+	n.CommandPrefix = ""
+	n.EnabledCommands = nil
+	n.CTCPReplies = nil
+	return n
+}
+
+func reloadDiscord(old, new discordSettings) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+	if old.token == new.token {
+		if conn, ok := connections.Get("discord"); ok {
+			conn.(*DiscordConn).Reconfigure(new.prefix, new.commands, new.roles, new.voice, new.topic)
+			return
+		}
+	}
+	if old.token != "" {
+		if err := connections.Remove("discord", config.ShutdownTimeout); err != nil {
+			log.Printf("Error disconnecting from Discord: %s\n", err)
+		}
+	}
+	if new.token == "" {
+		return
+	}
+	conn, err := NewDiscordConn(
+		new.token,
+		WithDiscordCommandPrefix(new.prefix),
+		WithDiscordEnabledCommands(new.commands),
+		WithDiscordRoles(new.roles),
+		WithDiscordVoice(new.voice),
+		WithDiscordTopic(new.topic),
+	)
+	if err == nil {
+		err = connections.Add(conn)
+	}
+	if err != nil {
+		log.Printf("Error setting up Discord: %s\n", err)
+	}
+}
+
+// Reconfigure applies the settings that can change without reconnecting:
+// it joins and parts channels, changes nick and swaps the command set and
+// CTCP replies.
+func (c *IrcConn) Reconfigure(n IrcNetwork) {
+	c.settingsMu.Lock()
+	oldChannels := c.autojoinChannels
+	oldNickname := c.desiredNickname
+	c.autojoinChannels = n.Channels
+	c.desiredNickname = n.Nickname
+	c.nickservPassword = n.NickservPass
+	c.commands = commands.NewCommandSet(n.CommandPrefix, n.EnabledCommands)
+	c.ctcpReplies = ctcpReplyMap(n.CTCPReplies)
+	c.settingsMu.Unlock()
+	if n.QuitMessage != "" {
+		c.cfg.QuitMessage = n.QuitMessage
+	}
+
+	if !c.conn.Connected() {
+		// We'll pick everything up when we reconnect.
+		return
+	}
+	if n.Nickname != oldNickname {
+		c.conn.Nick(n.Nickname)
+		if n.NickservPass != "" {
+			c.nickserv("IDENTIFY %s", n.NickservPass)
+		}
+	}
+	joined := make(map[string]bool)
+	for _, channel := range oldChannels {
+		joined[strings.ToLower(channel)] = true
+	}
+	for _, channel := range n.Channels {
+		if !joined[strings.ToLower(channel)] {
+			c.conn.Join(channel)
+		}
+		delete(joined, strings.ToLower(channel))
+	}
+	for _, channel := range oldChannels {
+		if joined[strings.ToLower(channel)] {
+			c.conn.Part(channel)
+		}
+	}
+}
+
+func (c *DiscordConn) Reconfigure(prefix string, enabled []string, roles map[string]string, voice voiceSettings, topic topicSettings) {
+	tmpl, err := parseTopicTemplate(topic.Template)
+	if err != nil {
+		log.Printf("Error parsing Discord topic template, keeping the old one: %s\n", err)
+	}
+	c.settingsMu.Lock()
+	c.commands = commands.NewCommandSet(prefix, enabled)
+	c.roles = roles
+	if err == nil {
+		c.topicSettings.Channel = topic.Channel
+		c.topicSettings.Template = topic.Template
+		c.topicTemplate = tmpl
+	}
+	if topic.Interval < minTopicInterval {
+		topic.Interval = minTopicInterval
+	}
+	c.topicSettings.Interval = topic.Interval
+	c.settingsMu.Unlock()
+	c.topic.setInterval(topic.Interval)
+	c.forgetPermissions("")
+	go c.registerAllSlashCommands()
+
+	c.setVoiceSettings(voice)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/models"
+)
+
+// How many requests .queue lists before pointing at the website.
+const maxQueueListed = 5
+
+func init() {
+	commands.NewCommand("request", requestCommand,
+		commands.WithVarArgs(1, maxSearchTerms),
+		commands.WithDescription("Request a song, by searching for it or by its #id from .search"),
+		commands.WithArgSpec(commands.Arg{Name: "song", Description: "What to search for, or #id", Rest: true}),
+	)
+	commands.NewCommand("queue", queueCommand,
+		commands.WithDescription("Show the song requests waiting to be played"),
+	)
+}
+
+// requestError is why a request was turned down, fit to show whoever made
+// it.
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+// requestMu stops two requests from both getting past the checks.
+var requestMu sync.Mutex
+
+// requestSong queues song for the user, if it isn't quarantined and neither
+// of them is cooling down. It returns a requestError if it turns it down.
+func requestSong(userID uint, song *models.Song) error {
+	if song.Quarantined {
+		return requestError(fmt.Sprintf("%s can't be requested.", songName(song)))
+	}
+	requestMu.Lock()
+	defer requestMu.Unlock()
+	var queued int
+	if err := db.Model(&models.SongRequest{}).Where("status = ?", models.RequestQueued).Count(&queued).Error; err != nil {
+		return err
+	}
+	if queued >= config.RequestQueueSize {
+		return requestError("The request queue is full. Try again once it's gone down a bit.")
+	}
+	var already int
+	if err := db.Model(&models.SongRequest{}).Where("song_id = ? AND status = ?", song.ID, models.RequestQueued).Count(&already).Error; err != nil {
+		return err
+	}
+	if already > 0 {
+		return requestError(fmt.Sprintf("%s is already in the queue.", songName(song)))
+	}
+	now := time.Now()
+	// A request that's been picked up counts as a play, since it won't be in
+	// playHistory until it's on air.
+	played, err := latest("playHistory", "played", "song_id = ?", song.ID)
+	if err != nil {
+		return err
+	}
+	picked, err := latest("songRequests", "picked_at", "song_id = ?", song.ID)
+	if err != nil {
+		return err
+	}
+	if picked.After(played) {
+		played = picked
+	}
+	if wait := played.Add(config.RequestSongCooldown).Sub(now); wait > 0 {
+		return requestError(fmt.Sprintf("%s was played recently. It can be requested again in %s.", songName(song), waitTime(wait)))
+	}
+	requested, err := latest("songRequests", "created_at", "user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if wait := requested.Add(config.RequestUserCooldown).Sub(now); wait > 0 {
+		return requestError(fmt.Sprintf("You can make another request in %s.", waitTime(wait)))
+	}
+	return db.Create(&models.SongRequest{
+		SongID: song.ID,
+		UserID: userID,
+		Status: models.RequestQueued,
+	}).Error
+}
+
+// latest is the greatest value of column in table, or the zero time if
+// there isn't one.
+func latest(table, column, where string, args ...interface{}) (time.Time, error) {
+	var row struct {
+		Latest *time.Time
+	}
+	err := db.Table(table).Select("MAX("+column+") AS latest").Where(where, args...).Scan(&row).Error
+	if err != nil || row.Latest == nil {
+		return time.Time{}, err
+	}
+	return *row.Latest, nil
+}
+
+// waitTime rounds d up into something friendly.
+func waitTime(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	switch {
+	case minutes <= 1:
+		return "a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	case minutes <= 60:
+		return "an hour"
+	default:
+		return fmt.Sprintf("%d hours", (minutes+59)/60)
+	}
+}
+
+// requestQueue returns the requests waiting to be played, oldest first, and
+// how many there are in all. A limit of 0 returns all of them.
+func requestQueue(limit int) ([]models.SongRequest, int, error) {
+	query := db.Model(&models.SongRequest{}).Where("status = ?", models.RequestQueued)
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	query = query.Order("created_at, id").Preload("Song").Preload("Song.Artist").Preload("User")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var requests []models.SongRequest
+	err := query.Find(&requests).Error
+	return requests, total, err
+}
+
+// pickRequest takes the oldest request off the queue, for the playback
+// backend. Songs quarantined since they were requested are passed over.
+func pickRequest() (*models.SongRequest, bool, error) {
+	requestMu.Lock()
+	defer requestMu.Unlock()
+	var request models.SongRequest
+	query := db.Joins("JOIN songs ON songs.id = songRequests.song_id").
+		Where("songRequests.status = ? AND NOT songs.quarantined", models.RequestQueued).
+		Order("songRequests.created_at, songRequests.id").
+		Preload("Song").Preload("Song.Artist").Preload("User").
+		First(&request)
+	if query.RecordNotFound() {
+		return nil, false, nil
+	}
+	if query.Error != nil {
+		return nil, false, query.Error
+	}
+	now := time.Now()
+	if err := db.Model(&request).Updates(map[string]interface{}{
+		"status":    models.RequestPicked,
+		"picked_at": now,
+	}).Error; err != nil {
+		return nil, false, err
+	}
+	return &request, true, nil
+}
+
+func requestCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	user, ok := ctx.Identify(msg.Source)
+	if !ok {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("You need to be linked to an Eden account for that. Use %slink to link one.", ctx.Prefix()))
+		return
+	}
+	song, ok := findRequestedSong(ctx, msg, strings.Join(args, " "))
+	if !ok {
+		return
+	}
+	err := requestSong(user.ID, song)
+	if reason, ok := err.(requestError); ok {
+		ctx.SendToUser(msg.Source, string(reason))
+		return
+	}
+	if err != nil {
+		log.Printf("Error requesting song %d for %s: %s\n", song.ID, user.Username, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	reply(ctx, msg, fmt.Sprintf("%s requested %s.", user.Username, songName(song)))
+}
+
+// findRequestedSong finds the one song terms means, or tells the user what
+// it might have meant.
+func findRequestedSong(ctx commands.CommandContext, msg commands.Message, terms string) (*models.Song, bool) {
+	var id uint64
+	if strings.HasPrefix(terms, "#") {
+		var err error
+		if id, err = strconv.ParseUint(terms[1:], 10, 64); err != nil {
+			ctx.SendToUser(msg.Source, fmt.Sprintf("%s isn't a song number.", terms))
+			return nil, false
+		}
+	} else {
+		songs, total, err := searchSongs(songQuery{
+			Terms: terms,
+			Sort:  "plays",
+			Limit: maxSearchListed,
+		})
+		if err != nil {
+			log.Printf("Error searching for %s: %s\n", terms, err)
+			ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+			return nil, false
+		}
+		switch {
+		case total == 0:
+			ctx.SendToUser(msg.Source, fmt.Sprintf("Nothing found for %s.", terms))
+			return nil, false
+		case total > 1:
+			ctx.SendToUser(msg.Source, fmt.Sprintf("%d songs match %s. Pick one with %srequest #id:", total, terms, ctx.Prefix()))
+			for _, song := range songs {
+				ctx.SendToUser(msg.Source, fmt.Sprintf("#%d %s", song.ID, song))
+			}
+			return nil, false
+		}
+		id = uint64(songs[0].ID)
+	}
+	var song models.Song
+	if db.Preload("Artist").First(&song, id).RecordNotFound() {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("There's no song %s.", terms))
+		return nil, false
+	}
+	return &song, true
+}
+
+func queueCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	requests, total, err := requestQueue(maxQueueListed)
+	if err != nil {
+		log.Printf("Error listing the request queue: %s\n", err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	if total == 0 {
+		ctx.SendToUser(msg.Source, "There are no requests waiting.")
+		return
+	}
+	ctx.SendToUser(msg.Source, fmt.Sprintf("%d requests waiting, next first:", total))
+	for i, request := range requests {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("%d. %s, for %s", i+1, songName(&request.Song), request.User.Username))
+	}
+	if total > len(requests) {
+		text := fmt.Sprintf("...and %d more.", total-len(requests))
+		if config.HTTPPublicURL != "" {
+			text += " See them all at " + publicURL("/queue")
+		}
+		ctx.SendToUser(msg.Source, text)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/events"
+	"github.com/santiclause/eden/models"
+)
+
+func init() {
+	commands.NewCommand("seen", seenCommand,
+		commands.WithArgs(1),
+		commands.WithDescription("When someone last said something, and where"),
+		commands.WithArgSpec(commands.Arg{Name: "nick", Description: "Who to look for"}),
+	)
+}
+
+// startSeen keeps track of the last thing everyone said in a channel, on
+// every connection.
+func startSeen() {
+	events.Subscribe(recordSeen, events.OfType(events.MessageReceivedEvent))
+}
+
+func recordSeen(e events.Event) {
+	m := e.(events.MessageReceived)
+	if m.Channel == "" || m.Notice {
+		return
+	}
+	text := m.Message.Content
+	if m.Action {
+		text = fmt.Sprintf("* %s %s", m.Message.Source.Name, text)
+	}
+	err := db.Exec("INSERT INTO seen (connection, identity, name, channel, text, seen_at) VALUES (?, ?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE name = VALUES(name), channel = VALUES(channel), text = VALUES(text), seen_at = VALUES(seen_at)",
+		m.Connection, identity(m.Message.Source), m.Message.Source.Name, channelName(m.Source), text, time.Now()).Error
+	if err != nil {
+		log.Printf("Error recording %s as seen: %s\n", m.Message.Source.Name, err)
+	}
+}
+
+// identity is how we recognise a user on their platform: the Discord user ID,
+// or the nick on IRC.
+func identity(user commands.User) string {
+	if user.PlatformID != "" {
+		return user.PlatformID
+	}
+	return strings.ToLower(user.Name)
+}
+
+// channelName turns a source's channel into something readable, since Discord
+// only gives us IDs.
+func channelName(source events.Source) string {
+	name := source.Channel
+	if ch, ok := source.Context.Channel(source.Channel); ok && ch.Name != "" {
+		name = ch.Name
+	}
+	if !strings.HasPrefix(source.Connection, "irc:") {
+		name = "#" + name
+	}
+	return name
+}
+
+// findUser resolves a name to an Eden user, by username or by a registered
+// IRC nick.
+func findUser(name string) (*models.User, bool) {
+	user := new(models.User)
+	if !db.Where("username = ?", name).First(user).RecordNotFound() {
+		return user, true
+	}
+	ircUser := models.IrcUser{
+		Nickname: name,
+	}
+	if db.Where(&ircUser).First(&ircUser).RecordNotFound() {
+		return nil, false
+	}
+	if err := db.Model(&ircUser).Related(user).Error; err != nil {
+		log.Printf("Error fetching user for ircUser: %s\n", err)
+		return nil, false
+	}
+	return user, true
+}
+
+// lastSeenUser finds the latest thing an Eden user said under any of their
+// IRC nicks or Discord accounts.
+func lastSeenUser(user *models.User, seen *models.Seen) bool {
+	var nicks, discordIDs []string
+	if err := db.Model(&models.IrcUser{}).Where("user_id = ?", user.ID).Pluck("LOWER(nickname)", &nicks).Error; err != nil {
+		log.Printf("Error fetching IRC nicks for %s: %s\n", user.Username, err)
+	}
+	if err := db.Model(&models.DiscordUser{}).Where("user_id = ?", user.ID).Pluck("discord_id", &discordIDs).Error; err != nil {
+		log.Printf("Error fetching Discord accounts for %s: %s\n", user.Username, err)
+	}
+	identities := append(nicks, discordIDs...)
+	if len(identities) == 0 {
+		return false
+	}
+	return !db.Where("identity IN (?)", identities).Order("seen_at desc").First(seen).RecordNotFound()
+}
+
+func seenCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	var seen models.Seen
+	found := false
+	if user, ok := findUser(args[0]); ok {
+		found = lastSeenUser(user, &seen)
+	}
+	if !found {
+		found = !db.Where("name = ?", args[0]).Order("seen_at desc").First(&seen).RecordNotFound()
+	}
+	if found {
+		reply(ctx, msg, fmt.Sprintf("%s was last seen %s ago on %s, in %s saying: %s", seen.Name, formatAge(seen.SeenAt), seen.Connection, seen.Channel, seen.Text))
+		return
+	}
+
+	// They haven't said anything, but the IRC log might have seen them
+	// coming or going.
+	var entry models.IrcLog
+	if db.Where("nick = ?", args[0]).Order("timestamp desc").First(&entry).RecordNotFound() {
+		reply(ctx, msg, fmt.Sprintf("I haven't seen %s.", args[0]))
+		return
+	}
+	reply(ctx, msg, fmt.Sprintf("%s was last seen %s ago on %s, %s", entry.Nick, formatAge(entry.Timestamp), entry.Network, describeLogEntry(entry)))
+}
+
+// reply answers in the channel a command came from, or privately if that's
+// how it was sent.
+func reply(ctx commands.CommandContext, msg commands.Message, text string) {
+	if msg.Public {
+		ctx.SendToChannel(msg.Target, text)
+	} else {
+		ctx.SendToUser(msg.Source, text)
+	}
+}
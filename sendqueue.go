@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Outgoing lines are sent in priority order, so that e.g. NickServ traffic
+// doesn't get stuck behind a long .faves listing.
+type sendPriority int
+
+const (
+	priorityServices sendPriority = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+const (
+	// The maximum length of an IRC line, including the trailing CRLF.
+	maxLineLength = 512
+	// The longest hostname we expect the server to prefix our messages with,
+	// used when we don't know our own host yet.
+	maxHostLength = 63
+	// How many lines each priority can have waiting. Past that the oldest
+	// go, since a flood of CTCP replies or long listings shouldn't take up
+	// memory without end when we can only send a line every few seconds.
+	maxQueuedLines = 100
+)
+
+// sendQueue is a token bucket rate limited queue of raw IRC lines. It allows
+// bursts of up to burst lines, refilling at rate lines per second.
+type sendQueue struct {
+	mu     sync.Mutex
+	queues [numPriorities][]string
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	send   func(string)
+	wake   chan struct{}
+	// die is closed to stop the goroutine running the queue, if there is one.
+	die chan struct{}
+}
+
+func newSendQueue(rate float64, burst int, send func(string)) *sendQueue {
+	if rate <= 0 {
+		rate = 0.5
+	}
+	if burst <= 0 {
+		burst = 5
+	}
+	return &sendQueue{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		send:   send,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// push queues lines to send at the given priority, dropping that priority's
+// oldest lines if there are too many.
+func (q *sendQueue) push(priority sendPriority, lines ...string) {
+	q.mu.Lock()
+	queue := append(q.queues[priority], lines...)
+	if dropped := len(queue) - maxQueuedLines; dropped > 0 {
+		log.Printf("Send queue full, dropping %d lines\n", dropped)
+		queue = append([]string(nil), queue[dropped:]...)
+	}
+	q.queues[priority] = queue
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queue := range q.queues {
+		if len(queue) > 0 {
+			q.queues[i] = queue[1:]
+			return queue[0], true
+		}
+	}
+	return "", false
+}
+
+func (q *sendQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, queue := range q.queues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// clear throws away everything that's queued, i.e. when we get disconnected.
+func (q *sendQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.queues {
+		q.queues[i] = nil
+	}
+}
+
+// take removes a token from the bucket. If there isn't one, it returns how
+// long we have to wait for one instead.
+func (q *sendQueue) take() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	q.last = now
+	if q.tokens >= 1 {
+		q.tokens--
+		return 0
+	}
+	return time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+}
+
+// start starts sending queued lines in the background, if we aren't already.
+func (q *sendQueue) start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.die == nil {
+		q.die = make(chan struct{})
+		go q.run(q.die)
+	}
+}
+
+func (q *sendQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.die != nil {
+		close(q.die)
+		q.die = nil
+	}
+}
+
+func (q *sendQueue) run(die chan struct{}) {
+	for {
+		if q.empty() {
+			select {
+			case <-q.wake:
+				continue
+			case <-die:
+				return
+			}
+		}
+		// We wait for a token before popping, so that anything more important
+		// that arrives in the meantime goes first.
+		if wait := q.take(); wait > 0 {
+			select {
+			case <-time.After(wait):
+				continue
+			case <-die:
+				return
+			}
+		}
+		if line, ok := q.pop(); ok {
+			q.send(line)
+		}
+	}
+}
+
+// splitMessage splits text into chunks of at most max bytes. Newlines always
+// start a new chunk, and otherwise we split on the last space that fits, or
+// failing that on the last UTF-8 boundary that fits.
+func splitMessage(text string, max int) []string {
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+	var chunks []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		for len(line) > max {
+			cut := max
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if space := strings.LastIndex(line[:cut+1], " "); space > 0 {
+				chunks = append(chunks, line[:space])
+				line = line[space+1:]
+			} else {
+				chunks = append(chunks, line[:cut])
+				line = line[cut:]
+			}
+		}
+		if line != "" {
+			chunks = append(chunks, line)
+		}
+	}
+	return chunks
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	// A DJ who's been quiet for longer than this has finished their session.
+	djSessionGap = time.Hour
+	// How many plays a refresh rolls up in one transaction.
+	statsBatchSize = 10000
+	// How long we leave new plays before rolling them up. IDs are handed out
+	// before the insert commits, so a slow transaction could otherwise
+	// commit a play below the watermark after we'd moved past it.
+	statsSettleDelay = time.Minute
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	defaultTopDays   = 7
+	maxTopListed     = 5
+)
+
+func init() {
+	commands.NewCommand("top", topCommand,
+		commands.WithVarArgs(0, 2),
+		commands.WithDescription("The most played songs or artists lately"),
+		commands.WithArgSpec(
+			commands.Arg{Name: "what", Description: "songs or artists"},
+			commands.Arg{Name: "days", Description: "How many days back to look", Type: commands.ArgInteger},
+		),
+	)
+	commands.NewCommand("stats", statsCommand,
+		commands.WithVarArgs(0, 1),
+		commands.WithDescription("Radio stats for the last month, or a DJ's"),
+		commands.WithArgSpec(commands.Arg{Name: "dj", Description: "Whose stats to show", Type: commands.ArgUser}),
+	)
+}
+
+// startStats keeps the stats rollups up to date in the background.
+func startStats() {
+	go func() {
+		for {
+			if err := refreshStats(); err != nil {
+				log.Printf("Error refreshing stats: %s\n", err)
+			}
+			time.Sleep(config.StatsRefreshInterval)
+		}
+	}()
+}
+
+// refreshStats rolls up the plays since the last refresh into
+// playStatsHourly and djSessions, a batch at a time so a big backlog doesn't
+// make for one huge transaction.
+func refreshStats() error {
+	for {
+		done, err := rollUpPlays()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+type rollupPlay struct {
+	ID       uint
+	DJ       uint
+	Played   time.Time
+	Duration uint
+	// Whether it's older than statsSettleDelay.
+	Settled bool
+}
+
+// rollUpPlays rolls up the next batch, returning true once it's caught up.
+func rollUpPlays() (bool, error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	done, err := rollUpBatch(tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return done, tx.Commit().Error
+}
+
+func rollUpBatch(tx *gorm.DB) (bool, error) {
+	var state struct {
+		LastID uint
+	}
+	if err := tx.Raw("SELECT last_id FROM statsRollups WHERE name = 'plays' FOR UPDATE").Scan(&state).Error; err != nil {
+		return false, err
+	}
+	var plays []rollupPlay
+	if err := tx.Raw("SELECT playHistory.id, playHistory.dj, playHistory.played, songs.duration, "+
+		"playHistory.played < NOW() - INTERVAL ? SECOND AS settled FROM playHistory "+
+		"JOIN songs ON songs.id = playHistory.song_id WHERE playHistory.id > ? ORDER BY playHistory.id LIMIT ?",
+		int(statsSettleDelay/time.Second), state.LastID, statsBatchSize).Scan(&plays).Error; err != nil {
+		return false, err
+	}
+	caughtUp := len(plays) < statsBatchSize
+	// Stop at the first play that hasn't settled, so that everything up to
+	// the new watermark has.
+	for i, play := range plays {
+		if !play.Settled {
+			plays, caughtUp = plays[:i], true
+			break
+		}
+	}
+	if len(plays) == 0 {
+		return true, nil
+	}
+	lastID := plays[len(plays)-1].ID
+	if err := tx.Exec("INSERT INTO playStatsHourly (day, hour, song_id, dj, plays) "+
+		"SELECT DATE(played), HOUR(played), song_id, dj, COUNT(*) FROM playHistory WHERE id > ? AND id <= ? "+
+		"GROUP BY DATE(played), HOUR(played), song_id, dj "+
+		"ON DUPLICATE KEY UPDATE plays = plays + VALUES(plays)", state.LastID, lastID).Error; err != nil {
+		return false, err
+	}
+
+	// Carry on from the last session, in case the DJ's still going.
+	var last []models.DJSession
+	if err := tx.Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+		return false, err
+	}
+	var session models.DJSession
+	if len(last) > 0 {
+		session = last[0]
+	}
+	changed := false
+	for _, play := range plays {
+		ended := play.Played.Add(time.Duration(play.Duration) * time.Second)
+		if session.Plays > 0 && session.DJ == play.DJ && play.Played.Sub(session.Ended) <= djSessionGap {
+			session.Plays++
+			if ended.After(session.Ended) {
+				session.Ended = ended
+			}
+			changed = true
+			continue
+		}
+		if changed {
+			if err := tx.Save(&session).Error; err != nil {
+				return false, err
+			}
+		}
+		session = models.DJSession{
+			DJ:      play.DJ,
+			Started: play.Played,
+			Ended:   ended,
+			Plays:   1,
+		}
+		changed = true
+	}
+	if err := tx.Save(&session).Error; err != nil {
+		return false, err
+	}
+
+	if err := tx.Exec("UPDATE statsRollups SET last_id = ? WHERE name = 'plays'", lastID).Error; err != nil {
+		return false, err
+	}
+	return caughtUp, nil
+}
+
+// The stats below read the rollups, so they can be up to
+// config.StatsRefreshInterval behind. Days count back from today, as the
+// database sees it.
+
+type dayPlays struct {
+	Day   time.Time
+	Plays int
+}
+
+func playsByDay(days int) ([]dayPlays, error) {
+	var rows []dayPlays
+	err := db.Table("playStatsHourly").Select("day, SUM(plays) AS plays").
+		Where("day > CURDATE() - INTERVAL ? DAY", days).
+		Group("day").Order("day").Scan(&rows).Error
+	return rows, err
+}
+
+type hourPlays struct {
+	Hour  int
+	Plays int
+}
+
+// playsByHour adds up the plays in each hour of the day.
+func playsByHour(days int) ([]hourPlays, error) {
+	var rows []hourPlays
+	err := db.Table("playStatsHourly").Select("hour, SUM(plays) AS plays").
+		Where("day > CURDATE() - INTERVAL ? DAY", days).
+		Group("hour").Order("hour").Scan(&rows).Error
+	return rows, err
+}
+
+type chartSong struct {
+	ID         uint
+	Title      string
+	ArtistID   uint
+	ArtistName string
+	Plays      int
+}
+
+func (s chartSong) String() string {
+	return s.ArtistName + " - " + s.Title
+}
+
+// topSongs is the most played songs, by dj if it isn't 0.
+func topSongs(days int, dj uint, limit int) ([]chartSong, error) {
+	query := db.Table("playStatsHourly").
+		Select("songs.id, songs.title, artists.id AS artist_id, artists.name AS artist_name, SUM(playStatsHourly.plays) AS plays").
+		Joins("JOIN songs ON songs.id = playStatsHourly.song_id").
+		Joins("JOIN artists ON artists.id = songs.artist_id").
+		Where("playStatsHourly.day > CURDATE() - INTERVAL ? DAY", days)
+	if dj != 0 {
+		query = query.Where("playStatsHourly.dj = ?", dj)
+	}
+	var rows []chartSong
+	err := query.Group("songs.id, artists.id").Order("plays DESC, songs.id").Limit(limit).Scan(&rows).Error
+	return rows, err
+}
+
+type chartArtist struct {
+	ID    uint
+	Name  string
+	Plays int
+}
+
+func topArtists(days, limit int) ([]chartArtist, error) {
+	var rows []chartArtist
+	err := db.Table("playStatsHourly").
+		Select("artists.id, artists.name, SUM(playStatsHourly.plays) AS plays").
+		Joins("JOIN songs ON songs.id = playStatsHourly.song_id").
+		Joins("JOIN artists ON artists.id = songs.artist_id").
+		Where("playStatsHourly.day > CURDATE() - INTERVAL ? DAY", days).
+		Group("artists.id").Order("plays DESC, artists.id").Limit(limit).Scan(&rows).Error
+	return rows, err
+}
+
+// djStat is how much a DJ played. Times are in seconds.
+type djStat struct {
+	DJ       uint
+	Username string
+	Plays    int
+	Songs    int
+	Sessions int
+	OnAir    int64
+	Longest  int64
+}
+
+func (s djStat) AverageSession() int64 {
+	if s.Sessions == 0 {
+		return 0
+	}
+	return s.OnAir / int64(s.Sessions)
+}
+
+// djStats adds up each DJ's plays and sessions, busiest first, or just dj's
+// if it isn't 0.
+func djStats(days int, dj uint) ([]djStat, error) {
+	plays := db.Table("playStatsHourly").Select("dj, SUM(plays) AS plays, COUNT(DISTINCT song_id) AS songs").
+		Where("day > CURDATE() - INTERVAL ? DAY", days)
+	sessions := db.Table("djSessions").
+		Select("dj, COUNT(*) AS sessions, SUM(TIMESTAMPDIFF(SECOND, started, ended)) AS on_air, MAX(TIMESTAMPDIFF(SECOND, started, ended)) AS longest").
+		Where("started > CURDATE() - INTERVAL ? DAY", days)
+	if dj != 0 {
+		plays = plays.Where("dj = ?", dj)
+		sessions = sessions.Where("dj = ?", dj)
+	}
+	var stats []djStat
+	if err := plays.Group("dj").Order("plays DESC").Scan(&stats).Error; err != nil {
+		return nil, err
+	}
+	var onAir []djStat
+	if err := sessions.Group("dj").Scan(&onAir).Error; err != nil {
+		return nil, err
+	}
+	byDJ := make(map[uint]*djStat)
+	var ids []uint
+	for i := range stats {
+		byDJ[stats[i].DJ] = &stats[i]
+		ids = append(ids, stats[i].DJ)
+	}
+	for _, s := range onAir {
+		if stat, ok := byDJ[s.DJ]; ok {
+			stat.Sessions, stat.OnAir, stat.Longest = s.Sessions, s.OnAir, s.Longest
+		}
+	}
+	if len(ids) > 0 {
+		var users []models.User
+		if err := db.Select("id, username").Where("id IN (?)", ids).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			byDJ[user.ID].Username = user.Username
+		}
+	}
+	return stats, nil
+}
+
+// neverPlayed is the songs in the library that have never been on air, and
+// how many there are in all. A limit of 0 just counts them. playHistory's
+// song_id index keeps this quick without a rollup.
+func neverPlayed(offset, limit int) ([]librarySong, int, error) {
+	query := libraryQuery().Where("NOT EXISTS (SELECT 1 FROM playHistory WHERE playHistory.song_id = songs.id)")
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		return nil, total, nil
+	}
+	var songs []librarySong
+	err := withLibraryStats(query).Order(librarySorts["artist"]).Offset(offset).Limit(limit).Scan(&songs).Error
+	return songs, total, err
+}
+
+// formatSeconds is a rough length of time, like 2h05m.
+func formatSeconds(seconds int64) string {
+	if seconds < 3600 {
+		return fmt.Sprintf("%dm", seconds/60)
+	}
+	return fmt.Sprintf("%dh%02dm", seconds/3600, seconds%3600/60)
+}
+
+func topCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	what, days := "songs", defaultTopDays
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			days = n
+		} else {
+			what = arg
+		}
+	}
+	if days < 1 || days > maxStatsDays {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("Pick between 1 and %d days.", maxStatsDays))
+		return
+	}
+	var lines []string
+	switch what {
+	case "songs", "song":
+		songs, err := topSongs(days, 0, maxTopListed)
+		if err != nil {
+			log.Printf("Error fetching top songs: %s\n", err)
+			ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+			return
+		}
+		for i, song := range songs {
+			lines = append(lines, fmt.Sprintf("%d. %s (%d)", i+1, song, song.Plays))
+		}
+	case "artists", "artist":
+		artists, err := topArtists(days, maxTopListed)
+		if err != nil {
+			log.Printf("Error fetching top artists: %s\n", err)
+			ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+			return
+		}
+		for i, artist := range artists {
+			lines = append(lines, fmt.Sprintf("%d. %s (%d)", i+1, artist.Name, artist.Plays))
+		}
+	default:
+		ctx.SendToUser(msg.Source, fmt.Sprintf("I can show the top songs or artists, not %s.", what))
+		return
+	}
+	if len(lines) == 0 {
+		reply(ctx, msg, fmt.Sprintf("Nothing's been played in the last %d days.", days))
+		return
+	}
+	reply(ctx, msg, fmt.Sprintf("Top %s, last %d days: %s", what, days, strings.Join(lines, " | ")))
+}
+
+func statsCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	if len(args) > 0 {
+		djStatsCommand(ctx, msg, args[0])
+		return
+	}
+	days := defaultStatsDays
+	daily, err := playsByDay(days)
+	if err != nil {
+		log.Printf("Error fetching daily plays: %s\n", err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	hourly, err := playsByHour(days)
+	if err != nil {
+		log.Printf("Error fetching hourly plays: %s\n", err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	_, unplayed, err := neverPlayed(0, 0)
+	if err != nil {
+		log.Printf("Error counting unplayed songs: %s\n", err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	total := 0
+	for _, day := range daily {
+		total += day.Plays
+	}
+	text := fmt.Sprintf("Last %d days: %d plays", days, total)
+	var busiest hourPlays
+	for _, hour := range hourly {
+		if hour.Plays > busiest.Plays {
+			busiest = hour
+		}
+	}
+	if busiest.Plays > 0 {
+		text += fmt.Sprintf(" | Busiest hour: %02d:00", busiest.Hour)
+	}
+	text += fmt.Sprintf(" | Never played: %d songs", unplayed)
+	reply(ctx, msg, text)
+}
+
+func djStatsCommand(ctx commands.CommandContext, msg commands.Message, name string) {
+	user, ok := findUser(name)
+	if !ok {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("I don't know who %s is.", name))
+		return
+	}
+	days := defaultStatsDays
+	stats, err := djStats(days, user.ID)
+	if err != nil {
+		log.Printf("Error fetching stats for %s: %s\n", user.Username, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	if len(stats) == 0 {
+		reply(ctx, msg, fmt.Sprintf("%s hasn't played anything in the last %d days.", user.Username, days))
+		return
+	}
+	s := stats[0]
+	text := fmt.Sprintf("%s, last %d days: %d plays of %d songs over %d sessions", user.Username, days, s.Plays, s.Songs, s.Sessions)
+	if s.Sessions > 0 {
+		text += fmt.Sprintf(" | Average session: %s, longest: %s", formatSeconds(s.AverageSession()), formatSeconds(s.Longest))
+	}
+	if top, err := topSongs(days, user.ID, 1); err != nil {
+		log.Printf("Error fetching top song for %s: %s\n", user.Username, err)
+	} else if len(top) > 0 {
+		text += fmt.Sprintf(" | Most played: %s (%d)", top[0], top[0].Plays)
+	}
+	reply(ctx, msg, text)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/events"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	// The most words a .tell will take, i.e. how long a note can be.
+	maxTellWords = 100
+	// How often we'll try to identify someone to see if there are notes for
+	// their Eden account. It can mean a NickServ query, so not every line.
+	tellCheckInterval = time.Minute
+)
+
+func init() {
+	commands.NewCommand("tell", tellCommand,
+		commands.WithVarArgs(2, maxTellWords+1),
+		commands.WithDescription("Leave someone a note for when they're next around"),
+		commands.WithArgSpec(
+			commands.Arg{Name: "user", Description: "Who the note is for"},
+			commands.Arg{Name: "message", Description: "The note", Rest: true},
+		),
+	)
+	commands.AddMessageHook(deliverTellsHook)
+}
+
+// tellIndex counts undelivered notes by recipient, so that we don't have to
+// go to the database for every message.
+type tellIndex struct {
+	names map[string]int
+	users map[uint]int
+	sync.RWMutex
+}
+
+var pendingTells = tellIndex{
+	names: make(map[string]int),
+	users: make(map[uint]int),
+}
+
+func (i *tellIndex) add(tell models.Tell, delta int) {
+	i.Lock()
+	defer i.Unlock()
+	if tell.RecipientID != nil {
+		if i.users[*tell.RecipientID] += delta; i.users[*tell.RecipientID] <= 0 {
+			delete(i.users, *tell.RecipientID)
+		}
+		return
+	}
+	name := strings.ToLower(tell.Recipient)
+	if i.names[name] += delta; i.names[name] <= 0 {
+		delete(i.names, name)
+	}
+}
+
+func (i *tellIndex) hasName(name string) bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.names[strings.ToLower(name)] > 0
+}
+
+func (i *tellIndex) hasUser(id uint) bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.users[id] > 0
+}
+
+func (i *tellIndex) anyUsers() bool {
+	i.RLock()
+	defer i.RUnlock()
+	return len(i.users) > 0
+}
+
+// tellChecks remembers who we've recently tried to identify, by connection.
+type tellChecks struct {
+	last      map[tellCheckKey]time.Time
+	lastPrune time.Time
+	sync.Mutex
+}
+
+type tellCheckKey struct {
+	ctx      commands.CommandContext
+	identity string
+}
+
+var recentTellChecks = tellChecks{
+	last: make(map[tellCheckKey]time.Time),
+}
+
+// due reports whether it's time to identify user again, and if so counts
+// this as the check.
+func (t *tellChecks) due(ctx commands.CommandContext, user commands.User) bool {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastPrune) > tellCheckInterval {
+		for key, last := range t.last {
+			if now.Sub(last) > tellCheckInterval {
+				delete(t.last, key)
+			}
+		}
+		t.lastPrune = now
+	}
+	key := tellCheckKey{ctx: ctx, identity: user.PlatformID + "/" + user.Name}
+	if last, ok := t.last[key]; ok && now.Sub(last) < tellCheckInterval {
+		return false
+	}
+	t.last[key] = now
+	return true
+}
+
+// reset lets everyone be checked again, e.g. when there's a new note.
+func (t *tellChecks) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.last = make(map[tellCheckKey]time.Time)
+}
+
+// startTells loads the notes that are still waiting to be delivered, and
+// delivers them when their recipients join a channel.
+func startTells() {
+	var tells []models.Tell
+	if err := db.Where("delivered_at IS NULL").Find(&tells).Error; err != nil {
+		log.Printf("Error loading undelivered tells: %s\n", err)
+	}
+	for _, tell := range tells {
+		pendingTells.add(tell, 1)
+	}
+	events.Subscribe(func(e events.Event) {
+		joined := e.(events.UserJoined)
+		deliverTells(joined.Context, joined.User, joined.Channel)
+	}, events.OfType(events.UserJoinedEvent))
+}
+
+func tellCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	tell := models.Tell{
+		Sender:    msg.Source.Name,
+		Recipient: args[0],
+		Message:   strings.Join(args[1:], " "),
+	}
+	if user, ok := findUser(args[0]); ok {
+		tell.RecipientID = &user.ID
+	}
+	if err := db.Create(&tell).Error; err != nil {
+		log.Printf("Error saving tell: %s\n", err)
+		reply(ctx, msg, "Sorry, I couldn't save that.")
+		return
+	}
+	pendingTells.add(tell, 1)
+	if tell.RecipientID != nil {
+		recentTellChecks.reset()
+	}
+	reply(ctx, msg, fmt.Sprintf("I'll pass that on when %s is around.", args[0]))
+}
+
+func deliverTellsHook(msg commands.Message, ctx commands.CommandContext) {
+	channel := ""
+	if msg.Public {
+		channel = msg.Target
+	}
+	deliverTells(ctx, msg.Source, channel)
+}
+
+// deliverTells hands over any notes waiting for user, in channel if there is
+// one and privately otherwise.
+func deliverTells(ctx commands.CommandContext, user commands.User, channel string) {
+	if pendingTells.hasName(user.Name) {
+		var tells []models.Tell
+		if err := db.Where("recipient = ? AND recipient_id IS NULL AND delivered_at IS NULL", user.Name).Order("created_at").Find(&tells).Error; err != nil {
+			log.Printf("Error fetching tells for %s: %s\n", user.Name, err)
+		}
+		sendTells(ctx, user, channel, tells)
+	}
+	if !pendingTells.anyUsers() || !recentTellChecks.due(ctx, user) {
+		return
+	}
+	// Identifying someone can mean asking NickServ, which we don't want to
+	// hold the commands up for.
+	go func() {
+		edenUser, ok := ctx.Identify(user)
+		if !ok || !pendingTells.hasUser(edenUser.ID) {
+			return
+		}
+		var tells []models.Tell
+		if err := db.Where("recipient_id = ? AND delivered_at IS NULL", edenUser.ID).Order("created_at").Find(&tells).Error; err != nil {
+			log.Printf("Error fetching tells for %s: %s\n", edenUser.Username, err)
+		}
+		sendTells(ctx, user, channel, tells)
+	}()
+}
+
+func sendTells(ctx commands.CommandContext, user commands.User, channel string, tells []models.Tell) {
+	for _, tell := range tells {
+		// Only whoever marks it delivered gets to send it, in case it's being
+		// delivered somewhere else at the same time.
+		result := db.Model(&tell).Where("delivered_at IS NULL").Update("delivered_at", time.Now())
+		if result.Error != nil {
+			log.Printf("Error marking tell %d delivered: %s\n", tell.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		pendingTells.add(tell, -1)
+		text := fmt.Sprintf("%s: %s said %s ago: %s", user.Name, tell.Sender, formatAge(tell.CreatedAt), tell.Message)
+		if channel != "" {
+			ctx.SendToChannel(channel, text)
+		} else {
+			ctx.SendToUser(user, text)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santiclause/eden/models"
+)
+
+var (
+	webServer *http.Server
+
+	//go:embed templates
+	templateFiles embed.FS
+	templates     = template.Must(template.New("").Funcs(template.FuncMap{
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"duration": func(seconds uint) string {
+			return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+		},
+	}).ParseFS(templateFiles, "templates/*.html"))
+)
+
+// startWebServer starts serving the website and API on config.HTTPListen in
+// the background.
+func startWebServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/", cors(apiV1()))
+	mux.HandleFunc("GET /{$}", indexPage)
+	mux.HandleFunc("GET /ws", liveFeed)
+	mux.HandleFunc("GET /debug/vars", requirePermission(adminPermission, expvar.Handler().ServeHTTP))
+	mux.HandleFunc("GET /login", loginForm)
+	mux.HandleFunc("POST /login", login)
+	mux.HandleFunc("POST /logout", logout)
+	mux.HandleFunc("GET /register", registerForm)
+	mux.HandleFunc("POST /register", register)
+	mux.HandleFunc("GET /reset/{token}", resetForm)
+	mux.HandleFunc("POST /reset/{token}", resetPassword)
+	mux.HandleFunc("GET /link", requireLogin(linkForm))
+	mux.HandleFunc("POST /link", requireLogin(linkAccount))
+	mux.HandleFunc("GET /users/{name}", profile)
+	mux.HandleFunc("GET /songs", library)
+	mux.HandleFunc("GET /songs/{id}", songInfo)
+	mux.HandleFunc("POST /songs/{id}/fave", faveForm(true, lookupSong))
+	mux.HandleFunc("POST /songs/{id}/unfave", faveForm(false, lookupSong))
+	mux.HandleFunc("POST /songs/{id}/request", requestForm)
+	mux.HandleFunc("GET /queue", queue)
+	mux.HandleFunc("POST /now-playing/fave", faveForm(true, nowPlayingSong))
+	mux.HandleFunc("POST /now-playing/unfave", faveForm(false, nowPlayingSong))
+	mux.HandleFunc("GET /upload", requireLogin(uploadForm))
+	handleUpload(mux, "POST /upload", upload)
+	mux.HandleFunc("GET /admin/uploads", requirePermission(moderatorPermission, adminUploads))
+	mux.HandleFunc("GET /admin/uploads/{id}/file", requirePermission(moderatorPermission, adminUploadFile))
+	mux.HandleFunc("POST /admin/uploads/{id}/approve", requirePermission(moderatorPermission, adminApproveUpload))
+	mux.HandleFunc("POST /admin/uploads/{id}/reject", requirePermission(moderatorPermission, adminRejectUpload))
+	mux.HandleFunc("POST /admin/songs/{id}/quarantine", requirePermission(moderatorPermission, quarantineForm(true)))
+	mux.HandleFunc("POST /admin/songs/{id}/unquarantine", requirePermission(moderatorPermission, quarantineForm(false)))
+	mux.HandleFunc("GET /admin", requirePermission(adminPermission, adminIndex))
+	mux.HandleFunc("GET /admin/users", requirePermission(adminPermission, adminUsers))
+	mux.HandleFunc("GET /admin/users/{id}", requirePermission(adminPermission, adminUser))
+	mux.HandleFunc("POST /admin/users/{id}", requirePermission(adminPermission, adminEditUser))
+	mux.HandleFunc("POST /admin/users/{id}/links/irc", requirePermission(adminPermission, adminLinkIrc))
+	mux.HandleFunc("POST /admin/users/{id}/links/{platform}/{identity}/delete", requirePermission(adminPermission, adminUnlink))
+	mux.HandleFunc("GET /admin/roles", requirePermission(adminPermission, adminRoles))
+	mux.HandleFunc("POST /admin/roles", requirePermission(adminPermission, adminCreateRole))
+	mux.HandleFunc("POST /admin/roles/{id}", requirePermission(adminPermission, adminEditRole))
+	mux.HandleFunc("POST /admin/roles/{id}/delete", requirePermission(adminPermission, adminDeleteRole))
+	mux.HandleFunc("GET /admin/audit", requirePermission(adminPermission, adminAudit))
+	webServer = &http.Server{
+		Addr:              config.HTTPListen,
+		Handler:           sessions(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	live.start()
+	webServer.RegisterOnShutdown(live.stop)
+	go func() {
+		if err := webServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving HTTP: %s\n", err)
+		}
+	}()
+}
+
+// stopWebServer lets requests in flight finish, for at most timeout.
+func stopWebServer(timeout time.Duration) {
+	if webServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := webServer.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %s\n", err)
+	}
+}
+
+// cors lets the configured origins use the API from the browser. Origins
+// listed by name get to send cookies; "*" lets anyone in, but only
+// anonymously.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && allowedOrigin(origin) {
+			if listedOrigin(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowedOrigin(origin string) bool {
+	for _, allowed := range config.HTTPCORSOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return listedOrigin(origin)
+}
+
+// listedOrigin is whether origin is in the config by name.
+func listedOrigin(origin string) bool {
+	for _, allowed := range config.HTTPCORSOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %s\n", err)
+	}
+}
+
+// httpError answers the API in JSON and everything else in plain text.
+func httpError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(w, status, message)
+	} else {
+		http.Error(w, message, status)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// intParam reads a positive integer query parameter, falling back to def and
+// capping it at max.
+func intParam(r *http.Request, name string, def, max int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// page is what every template gets: the layout's bits, and Data for the page
+// itself.
+type page struct {
+	Title string
+	// Where we are, for forms that send people back here.
+	Path       string
+	Session    *models.Session
+	CSRF       string
+	NowPlaying NowPlaying
+	// Whether the logged in user has faved what's playing.
+	NowPlayingFaved bool
+	Data            interface{}
+}
+
+// render writes the named template, wrapped in the layout.
+func render(w http.ResponseWriter, r *http.Request, status int, name, title string, data interface{}) {
+	p := page{
+		Title:      title,
+		Path:       r.URL.RequestURI(),
+		CSRF:       csrfToken(w, r),
+		NowPlaying: CurrentlyPlaying(),
+		Data:       data,
+	}
+	p.Session, _ = requestSession(r)
+	if p.Session != nil {
+		if song, ok := currentSong(); ok {
+			p.NowPlayingFaved = isFave(p.Session.UserID, song.ID)
+		}
+	}
+	// Render to a buffer first, so a broken template doesn't leave half a
+	// page behind it.
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, p); err != nil {
+		log.Printf("Error rendering %s: %s\n", name, err)
+		http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+func indexPage(w http.ResponseWriter, r *http.Request) {
+	render(w, r, http.StatusOK, "index", "", nil)
+}
+
+// publicURL is where people outside can reach path on the website.
+func publicURL(path string) string {
+	return strings.TrimRight(config.HTTPPublicURL, "/") + path
+}
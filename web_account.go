@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/santiclause/eden/commands"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores anything past this.
+	maxPasswordBytes      = 72
+	passwordResetLifetime = time.Hour
+	// Accounts one address can create per window.
+	maxRegistrationsPerIP = 5
+)
+
+// Usernames fit users.username, and stick to characters that are easy to type
+// on IRC and Discord.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-\[\]{}|^]{2,60}$`)
+
+var registrationThrottle = newLoginThrottle(maxRegistrationsPerIP)
+
+func init() {
+	commands.NewCommand("resetpw", resetpwCommand,
+		commands.WithDescription("Get a link to set a new password on the website"),
+	)
+}
+
+func checkUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("Usernames are 2 to 60 letters, numbers or any of _.-[]{}|^.")
+	}
+	var count int
+	if err := db.Model(&models.User{}).Where("LOWER(username) = LOWER(?)", username).Count(&count).Error; err != nil {
+		log.Printf("Error checking username %s: %s\n", username, err)
+		return fmt.Errorf("Sorry, something went wrong.")
+	}
+	if count > 0 {
+		return fmt.Errorf("Somebody already has that username.")
+	}
+	return nil
+}
+
+func checkNewPassword(password, confirm string) error {
+	switch {
+	case utf8.RuneCountInString(password) < minPasswordLength:
+		return fmt.Errorf("Passwords need to be at least %d characters.", minPasswordLength)
+	case len(password) > maxPasswordBytes:
+		return fmt.Errorf("Passwords can't be longer than %d bytes.", maxPasswordBytes)
+	case password != confirm:
+		return fmt.Errorf("The passwords don't match.")
+	}
+	return nil
+}
+
+type registerPage struct {
+	Username string
+	Error    string
+}
+
+func registerForm(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requestSession(r); ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	render(w, r, http.StatusOK, "register", "Sign up", registerPage{})
+}
+
+func register(w http.ResponseWriter, r *http.Request) {
+	page := registerPage{Username: strings.TrimSpace(r.PostFormValue("username"))}
+	password := r.PostFormValue("password")
+	ip := clientIP(r)
+	if !registrationThrottle.allowed(ip) {
+		page.Error = "You've made enough accounts for now. Try again later."
+		render(w, r, http.StatusTooManyRequests, "register", "Sign up", page)
+		return
+	}
+	err := checkUsername(page.Username)
+	if err == nil {
+		err = checkNewPassword(password, r.PostFormValue("confirm"))
+	}
+	if err != nil {
+		page.Error = err.Error()
+		render(w, r, http.StatusBadRequest, "register", "Sign up", page)
+		return
+	}
+	user := models.User{Username: page.Username}
+	if user.Password, err = hashPassword(password); err == nil {
+		// The unique key catches anyone who got the name in the meantime.
+		err = db.Create(&user).Error
+	}
+	if err == nil {
+		// Each account counts against the address, like a failed login.
+		registrationThrottle.fail(ip)
+		err = newSession(w, r, &user)
+	}
+	if err != nil {
+		log.Printf("Error registering %s: %s\n", page.Username, err)
+		page.Error = "Sorry, something went wrong."
+		render(w, r, http.StatusInternalServerError, "register", "Sign up", page)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// resetpwCommand sends a password reset link to whoever's linked to an Eden
+// account. Since we can't send email, proving who you are on IRC or Discord
+// is how you get back in.
+func resetpwCommand(ctx commands.CommandContext, msg commands.Message, args ...string) {
+	if config.HTTPPublicURL == "" {
+		ctx.SendToUser(msg.Source, "The website isn't set up, so there's no password to reset.")
+		return
+	}
+	user, ok := ctx.Identify(msg.Source)
+	if !ok {
+		ctx.SendToUser(msg.Source, fmt.Sprintf("You're not linked to an Eden account. On IRC, you need to be identified with NickServ. Use %slink to link one.", ctx.Prefix()))
+		return
+	}
+	token, err := randomToken()
+	if err == nil {
+		err = db.Create(&models.PasswordReset{
+			Token:     hashToken(token),
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(passwordResetLifetime),
+		}).Error
+	}
+	if err != nil {
+		log.Printf("Error creating password reset for %s: %s\n", user.Username, err)
+		ctx.SendToUser(msg.Source, "Sorry, something went wrong.")
+		return
+	}
+	if err := db.Where("expires_at < ?", time.Now()).Delete(models.PasswordReset{}).Error; err != nil {
+		log.Printf("Error deleting expired password resets: %s\n", err)
+	}
+	ctx.SendToUser(msg.Source, fmt.Sprintf("To set a new password for %s, go to %s within %d minutes. Don't share this link.",
+		user.Username, publicURL("/reset/"+token), int(passwordResetLifetime.Minutes())))
+}
+
+func lookupPasswordReset(token string) (*models.PasswordReset, bool) {
+	var reset models.PasswordReset
+	if db.Preload("User").Where("token = ? AND expires_at > ?", hashToken(token), time.Now()).First(&reset).RecordNotFound() {
+		return nil, false
+	}
+	return &reset, true
+}
+
+type resetPage struct {
+	Username string
+	Error    string
+}
+
+func resetForm(w http.ResponseWriter, r *http.Request) {
+	reset, ok := lookupPasswordReset(r.PathValue("token"))
+	if !ok {
+		render(w, r, http.StatusNotFound, "reset", "Reset your password", resetPage{Error: "That link is wrong or has expired. Run .resetpw again for a new one."})
+		return
+	}
+	render(w, r, http.StatusOK, "reset", "Reset your password", resetPage{Username: reset.User.Username})
+}
+
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	reset, ok := lookupPasswordReset(r.PathValue("token"))
+	if !ok {
+		render(w, r, http.StatusNotFound, "reset", "Reset your password", resetPage{Error: "That link is wrong or has expired. Run .resetpw again for a new one."})
+		return
+	}
+	page := resetPage{Username: reset.User.Username}
+	password := r.PostFormValue("password")
+	if err := checkNewPassword(password, r.PostFormValue("confirm")); err != nil {
+		page.Error = err.Error()
+		render(w, r, http.StatusBadRequest, "reset", "Reset your password", page)
+		return
+	}
+	hash, err := hashPassword(password)
+	if err == nil {
+		err = db.Model(&reset.User).Update("password", hash).Error
+	}
+	if err != nil {
+		log.Printf("Error resetting password for %s: %s\n", reset.User.Username, err)
+		page.Error = "Sorry, something went wrong."
+		render(w, r, http.StatusInternalServerError, "reset", "Reset your password", page)
+		return
+	}
+	// The link is single use, and whoever knew the old password shouldn't
+	// stay logged in with it.
+	if err := db.Where("user_id = ?", reset.UserID).Delete(models.PasswordReset{}).Error; err != nil {
+		log.Printf("Error deleting password resets for %s: %s\n", reset.User.Username, err)
+	}
+	if err := db.Where("user_id = ?", reset.UserID).Delete(models.Session{}).Error; err != nil {
+		log.Printf("Error deleting sessions for %s: %s\n", reset.User.Username, err)
+	}
+	accountThrottle.reset(strings.ToLower(reset.User.Username))
+	if err := newSession(w, r, &reset.User); err != nil {
+		log.Printf("Error creating session for %s: %s\n", reset.User.Username, err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type linkPage struct {
+	Code   string
+	Linked string
+	Error  string
+}
+
+func linkForm(w http.ResponseWriter, r *http.Request) {
+	render(w, r, http.StatusOK, "link", "Link an account", linkPage{})
+}
+
+// linkAccount takes a code from .link on IRC or Discord and links that
+// account to whoever's logged in.
+func linkAccount(w http.ResponseWriter, r *http.Request) {
+	session, _ := requestSession(r)
+	page := linkPage{Code: strings.TrimSpace(r.PostFormValue("code"))}
+	id, err := confirmLinkCode(page.Code, &session.User)
+	if err != nil {
+		page.Error = err.Error()
+		render(w, r, http.StatusBadRequest, "link", "Link an account", page)
+		return
+	}
+	render(w, r, http.StatusOK, "link", "Link an account", linkPage{Linked: id.String()})
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	adminPermission   = "super"
+	adminUsersPerPage = 50
+	auditLogPerPage   = 100
+)
+
+// hasPermission reports whether user has the named permission through any of
+// their roles.
+func hasPermission(user *models.User, name string) bool {
+	if err := user.GetPermissions(db); err != nil {
+		log.Printf("Error fetching permissions for %s: %s\n", user.Username, err)
+		return false
+	}
+	for _, p := range user.Permissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission only lets through people who are logged in with the named
+// permission.
+func requirePermission(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requestSession(r)
+		if !ok {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if !hasPermission(&session.User, name) {
+			http.Error(w, "You can't do that.", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// errSomethingWrong is what people see when the database lets us down.
+var errSomethingWrong = errors.New("Sorry, something went wrong.")
+
+// transaction runs change in a transaction, which is committed if it returns
+// nil and rolled back if not.
+func transaction(change func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		log.Printf("Error starting transaction: %s\n", tx.Error)
+		return errSomethingWrong
+	}
+	if err := change(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error committing transaction: %s\n", err)
+		return errSomethingWrong
+	}
+	return nil
+}
+
+// audit records a change made through the admin pages. It goes in the same
+// transaction as the change, so that neither happens without the other.
+func audit(tx *gorm.DB, r *http.Request, action, target, detail string) error {
+	entry := models.AuditLog{
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	if session, ok := requestSession(r); ok {
+		entry.UserID = &session.UserID
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		log.Printf("Error writing audit log for %s %s: %s\n", action, target, err)
+		return errSomethingWrong
+	}
+	return nil
+}
+
+// forgetAllPermissions makes the connections look permissions up afresh, after
+// roles have changed.
+func forgetAllPermissions() {
+	for _, conn := range connections.Connections() {
+		if conn, ok := conn.(*DiscordConn); ok {
+			conn.forgetPermissions("")
+		}
+	}
+}
+
+func adminIndex(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+type adminUsersPage struct {
+	Query string
+	Users []models.User
+	Page  int
+	More  bool
+}
+
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+	p := adminUsersPage{
+		Query: strings.TrimSpace(r.FormValue("q")),
+		Page:  intParam(r, "page", 1, 1<<20),
+	}
+	query := db.Preload("Roles").Order("username")
+	if p.Query != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(p.Query) + "%"
+		query = query.Where("username LIKE ? OR id IN (SELECT user_id FROM ircUsers WHERE nickname LIKE ?) OR id IN (SELECT user_id FROM discordUsers WHERE name LIKE ?)", like, like, like)
+	}
+	// Fetch one extra to see if there's another page.
+	if err := query.Offset((p.Page - 1) * adminUsersPerPage).Limit(adminUsersPerPage + 1).Find(&p.Users).Error; err != nil {
+		log.Printf("Error listing users: %s\n", err)
+	}
+	if len(p.Users) > adminUsersPerPage {
+		p.Users, p.More = p.Users[:adminUsersPerPage], true
+	}
+	render(w, r, http.StatusOK, "admin_users", "Users", p)
+}
+
+type adminUserPage struct {
+	User       *models.User
+	Roles      []models.Role
+	HasRole    map[uint]bool
+	Identities []platformIdentity
+	Error      string
+}
+
+func adminUserFromPath(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	var user models.User
+	if err != nil || db.Preload("Roles").First(&user, id).RecordNotFound() {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return &user, true
+}
+
+func renderAdminUser(w http.ResponseWriter, r *http.Request, status int, user *models.User, message string) {
+	p := adminUserPage{
+		User:    user,
+		HasRole: make(map[uint]bool),
+		Error:   message,
+	}
+	if err := db.Order("name").Find(&p.Roles).Error; err != nil {
+		log.Printf("Error listing roles: %s\n", err)
+	}
+	for _, role := range user.Roles {
+		p.HasRole[role.ID] = true
+	}
+	var err error
+	if p.Identities, err = linkedIdentities(user); err != nil {
+		log.Printf("Error fetching linked identities for %s: %s\n", user.Username, err)
+	}
+	render(w, r, status, "admin_user", user.Username, p)
+}
+
+func adminUser(w http.ResponseWriter, r *http.Request) {
+	if user, ok := adminUserFromPath(w, r); ok {
+		renderAdminUser(w, r, http.StatusOK, user, "")
+	}
+}
+
+// adminEditUser renames a user and sets their roles.
+func adminEditUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserFromPath(w, r)
+	if !ok {
+		return
+	}
+	target := fmt.Sprintf("user %d", user.ID)
+	if username := strings.TrimSpace(r.PostFormValue("username")); username != user.Username {
+		if !strings.EqualFold(username, user.Username) {
+			if err := checkUsername(username); err != nil {
+				renderAdminUser(w, r, http.StatusBadRequest, user, err.Error())
+				return
+			}
+		}
+		err := transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(user).Update("username", username).Error; err != nil {
+				return err
+			}
+			return audit(tx, r, "rename user", target, fmt.Sprintf("%s -> %s", user.Username, username))
+		})
+		if err != nil {
+			log.Printf("Error renaming %s: %s\n", user.Username, err)
+			renderAdminUser(w, r, http.StatusInternalServerError, user, "Sorry, something went wrong.")
+			return
+		}
+		user.Username = username
+	}
+
+	var roles []models.Role
+	if ids := r.PostForm["roles"]; len(ids) > 0 {
+		if err := db.Where("id IN (?)", ids).Find(&roles).Error; err != nil {
+			log.Printf("Error fetching roles: %s\n", err)
+			renderAdminUser(w, r, http.StatusInternalServerError, user, "Sorry, something went wrong.")
+			return
+		}
+	}
+	before, after := roleNames(user.Roles), roleNames(roles)
+	if before != after {
+		err := transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(user).Association("Roles").Replace(roles).Error; err != nil {
+				return err
+			}
+			return audit(tx, r, "set roles", target, fmt.Sprintf("%s: [%s] -> [%s]", user.Username, before, after))
+		})
+		if err != nil {
+			log.Printf("Error setting roles for %s: %s\n", user.Username, err)
+			renderAdminUser(w, r, http.StatusInternalServerError, user, "Sorry, something went wrong.")
+			return
+		}
+		forgetAllPermissions()
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+func roleNames(roles []models.Role) string {
+	var names []string
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// adminLinkIrc links an IRC nick to a user, as if they'd used .link.
+func adminLinkIrc(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserFromPath(w, r)
+	if !ok {
+		return
+	}
+	nick := strings.TrimSpace(r.PostFormValue("nickname"))
+	if nick == "" {
+		renderAdminUser(w, r, http.StatusBadRequest, user, "Which nick?")
+		return
+	}
+	id := platformIdentity{Platform: "irc", Identity: nick, Name: nick}
+	err := transaction(func(tx *gorm.DB) error {
+		if err := linkIdentity(tx, id, user.ID); err != nil {
+			return err
+		}
+		return audit(tx, r, "link", fmt.Sprintf("user %d", user.ID), fmt.Sprintf("%s: %s", user.Username, id))
+	})
+	if err != nil {
+		renderAdminUser(w, r, http.StatusBadRequest, user, err.Error())
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// adminUnlink removes an IRC nick or Discord account from a user.
+func adminUnlink(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserFromPath(w, r)
+	if !ok {
+		return
+	}
+	id := platformIdentity{
+		Platform: r.PathValue("platform"),
+		Identity: r.PathValue("identity"),
+		Name:     r.PathValue("identity"),
+	}
+	err := transaction(func(tx *gorm.DB) error {
+		if err := unlinkIdentity(tx, id, user.ID); err != nil {
+			return err
+		}
+		return audit(tx, r, "unlink", fmt.Sprintf("user %d", user.ID), fmt.Sprintf("%s: %s %s", user.Username, id.Platform, id.Identity))
+	})
+	if err != nil {
+		renderAdminUser(w, r, http.StatusBadRequest, user, err.Error())
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+type adminRolesPage struct {
+	Roles       []models.Role
+	Permissions []models.Permission
+	// Role ID to permission ID.
+	Granted map[uint]map[uint]bool
+	Error   string
+}
+
+func renderAdminRoles(w http.ResponseWriter, r *http.Request, status int, message string) {
+	p := adminRolesPage{
+		Granted: make(map[uint]map[uint]bool),
+		Error:   message,
+	}
+	if err := db.Preload("Permissions").Order("name").Find(&p.Roles).Error; err != nil {
+		log.Printf("Error listing roles: %s\n", err)
+	}
+	if err := db.Order("name").Find(&p.Permissions).Error; err != nil {
+		log.Printf("Error listing permissions: %s\n", err)
+	}
+	for _, role := range p.Roles {
+		p.Granted[role.ID] = make(map[uint]bool)
+		for _, permission := range role.Permissions {
+			p.Granted[role.ID][permission.ID] = true
+		}
+	}
+	render(w, r, status, "admin_roles", "Roles", p)
+}
+
+func adminRoles(w http.ResponseWriter, r *http.Request) {
+	renderAdminRoles(w, r, http.StatusOK, "")
+}
+
+func adminCreateRole(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" || len(name) > 60 {
+		renderAdminRoles(w, r, http.StatusBadRequest, "Role names are 1 to 60 characters.")
+		return
+	}
+	var count int
+	db.Model(&models.Role{}).Where("name = ?", name).Count(&count)
+	if count > 0 {
+		renderAdminRoles(w, r, http.StatusBadRequest, "There's already a role called that.")
+		return
+	}
+	role := models.Role{Name: name}
+	err := transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&role).Error; err != nil {
+			return err
+		}
+		return audit(tx, r, "create role", fmt.Sprintf("role %d", role.ID), name)
+	})
+	if err != nil {
+		log.Printf("Error creating role %s: %s\n", name, err)
+		renderAdminRoles(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+		return
+	}
+	http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+}
+
+func adminRoleFromPath(w http.ResponseWriter, r *http.Request) (*models.Role, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	var role models.Role
+	if err != nil || db.Preload("Permissions").First(&role, id).RecordNotFound() {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return &role, true
+}
+
+// adminEditRole sets the permissions a role grants.
+func adminEditRole(w http.ResponseWriter, r *http.Request) {
+	role, ok := adminRoleFromPath(w, r)
+	if !ok {
+		return
+	}
+	var permissions []models.Permission
+	if ids := r.PostForm["permissions"]; len(ids) > 0 {
+		if err := db.Where("id IN (?)", ids).Find(&permissions).Error; err != nil {
+			log.Printf("Error fetching permissions: %s\n", err)
+			renderAdminRoles(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+			return
+		}
+	}
+	before, after := permissionNames(role.Permissions), permissionNames(permissions)
+	if before != after {
+		err := transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(role).Association("Permissions").Replace(permissions).Error; err != nil {
+				return err
+			}
+			return audit(tx, r, "set permissions", fmt.Sprintf("role %d", role.ID), fmt.Sprintf("%s: [%s] -> [%s]", role.Name, before, after))
+		})
+		if err != nil {
+			log.Printf("Error setting permissions for role %s: %s\n", role.Name, err)
+			renderAdminRoles(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+			return
+		}
+		forgetAllPermissions()
+	}
+	http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+}
+
+func permissionNames(permissions []models.Permission) string {
+	var names []string
+	for _, permission := range permissions {
+		names = append(names, permission.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func adminDeleteRole(w http.ResponseWriter, r *http.Request) {
+	role, ok := adminRoleFromPath(w, r)
+	if !ok {
+		return
+	}
+	// user_roles and role_permissions cascade.
+	err := transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(role).Error; err != nil {
+			return err
+		}
+		return audit(tx, r, "delete role", fmt.Sprintf("role %d", role.ID), role.Name)
+	})
+	if err != nil {
+		log.Printf("Error deleting role %s: %s\n", role.Name, err)
+		renderAdminRoles(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+		return
+	}
+	forgetAllPermissions()
+	http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+}
+
+type adminAuditPage struct {
+	Entries []models.AuditLog
+	Page    int
+	More    bool
+}
+
+func adminAudit(w http.ResponseWriter, r *http.Request) {
+	p := adminAuditPage{Page: intParam(r, "page", 1, 1<<20)}
+	if err := db.Preload("User").Order("id desc").Offset((p.Page - 1) * auditLogPerPage).Limit(auditLogPerPage + 1).Find(&p.Entries).Error; err != nil {
+		log.Printf("Error listing audit log: %s\n", err)
+	}
+	if len(p.Entries) > auditLogPerPage {
+		p.Entries, p.More = p.Entries[:auditLogPerPage], true
+	}
+	render(w, r, http.StatusOK, "admin_audit", "Audit log", p)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	favesPerPage    = 50
+	maxFavesPerPage = 500
+)
+
+type profilePage struct {
+	User  *models.User
+	Faves []models.Fave
+	Total int
+	Sort  string
+	Order string
+	Page  int
+	Pages int
+}
+
+func (p profilePage) Link(sort, order string, page int) string {
+	v := url.Values{}
+	v.Set("sort", sort)
+	v.Set("order", order)
+	v.Set("page", strconv.Itoa(page))
+	return "?" + v.Encode()
+}
+
+func lookupUsername(name string) (*models.User, bool) {
+	var user models.User
+	if db.Where("username = ?", name).First(&user).RecordNotFound() {
+		return nil, false
+	}
+	return &user, true
+}
+
+func profile(w http.ResponseWriter, r *http.Request) {
+	user, ok := lookupUsername(r.PathValue("name"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	p := profilePage{
+		User:  user,
+		Sort:  r.FormValue("sort"),
+		Order: r.FormValue("order"),
+		Page:  intParam(r, "page", 1, 1<<20),
+	}
+	if _, ok := faveSorts[p.Sort]; !ok {
+		p.Sort = "added"
+	}
+	if p.Order != "asc" {
+		p.Order = "desc"
+	}
+	var err error
+	p.Faves, p.Total, err = listFaves(user.ID, faveOrder(p.Sort, p.Order), (p.Page-1)*favesPerPage, favesPerPage)
+	if err != nil {
+		log.Printf("Error listing faves for %s: %s\n", user.Username, err)
+	}
+	p.Pages = (p.Total + favesPerPage - 1) / favesPerPage
+	render(w, r, http.StatusOK, "profile", user.Username, p)
+}
+
+type songPage struct {
+	Song    *models.Song
+	Stats   *librarySong
+	FavedBy []string
+	Faved   bool
+	// Why a request for it was just turned down.
+	RequestError string
+	// Whether the viewer can quarantine it.
+	CanModerate bool
+}
+
+func lookupSong(w http.ResponseWriter, r *http.Request) (*models.Song, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	var song models.Song
+	if err != nil || db.Preload("Artist").First(&song, id).RecordNotFound() {
+		return nil, false
+	}
+	return &song, true
+}
+
+func songInfo(w http.ResponseWriter, r *http.Request) {
+	song, ok := lookupSong(w, r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	renderSongPage(w, r, http.StatusOK, songPage{Song: song})
+}
+
+func renderSongPage(w http.ResponseWriter, r *http.Request, status int, p songPage) {
+	song := p.Song
+	p.Stats, _ = findLibrarySong(song.ID)
+	var err error
+	if p.FavedBy, err = favedBy(song.ID); err != nil {
+		log.Printf("Error fetching faves of song %d: %s\n", song.ID, err)
+	}
+	if session, ok := requestSession(r); ok {
+		p.Faved = isFave(session.UserID, song.ID)
+		p.CanModerate = hasPermission(&session.User, moderatorPermission)
+	}
+	render(w, r, status, "song", songName(song), p)
+}
+
+// faveForm handles the fave and unfave buttons, then sends people back where
+// they were.
+func faveForm(add bool, song func(w http.ResponseWriter, r *http.Request) (*models.Song, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next := safeRedirect(r.PostFormValue("next"))
+		session, ok := requestSession(r)
+		if !ok {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+		s, ok := song(w, r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var err error
+		if add {
+			_, err = addFave(session.UserID, s.ID)
+		} else {
+			_, err = removeFave(session.UserID, s.ID)
+		}
+		if err != nil {
+			log.Printf("Error changing fave for %s: %s\n", session.User.Username, err)
+			http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+func nowPlayingSong(w http.ResponseWriter, r *http.Request) (*models.Song, bool) {
+	return currentSong()
+}
+
+// apiSetFave faves (PUT) or unfaves (DELETE) a song for whoever's logged in.
+func apiSetFave(w http.ResponseWriter, r *http.Request) {
+	session, ok := requestSession(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+	song, ok := lookupSong(w, r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such song")
+		return
+	}
+	faved := r.Method == http.MethodPut
+	var err error
+	if faved {
+		_, err = addFave(session.UserID, song.ID)
+	} else {
+		_, err = removeFave(session.UserID, song.ID)
+	}
+	if err != nil {
+		log.Printf("Error changing fave for %s: %s\n", session.User.Username, err)
+		writeError(w, http.StatusInternalServerError, "couldn't change the fave")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"faved": faved})
+}
+
+type apiFaveResponse struct {
+	Song  apiSongResponse `json:"song"`
+	Added time.Time       `json:"added"`
+}
+
+type apiFavesResponse struct {
+	Total int               `json:"total"`
+	Page  int               `json:"page"`
+	Faves []apiFaveResponse `json:"faves"`
+}
+
+// apiFaves lists a user's faves as JSON a page at a time, or all of them as
+// an M3U playlist or CSV.
+func apiFaves(w http.ResponseWriter, r *http.Request) {
+	user, ok := lookupUsername(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such user")
+		return
+	}
+	format := r.FormValue("format")
+	order := faveOrder(r.FormValue("sort"), r.FormValue("order"))
+	page := intParam(r, "page", 1, 1<<20)
+	limit := intParam(r, "limit", favesPerPage, maxFavesPerPage)
+	if format == "m3u" || format == "csv" {
+		page, limit = 1, 0
+	}
+	faves, total, err := listFaves(user.ID, order, (page-1)*limit, limit)
+	if err != nil {
+		log.Printf("Error listing faves for %s: %s\n", user.Username, err)
+		writeError(w, http.StatusInternalServerError, "couldn't list the faves")
+		return
+	}
+	switch format {
+	case "m3u":
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.m3u"`, url.PathEscape(user.Username)))
+		fmt.Fprint(w, "#EXTM3U\n")
+		// The library files aren't served, so each entry points at the
+		// song's page.
+		for _, fave := range faves {
+			fmt.Fprintf(w, "#EXTINF:%d,%s\n%s\n", fave.Song.Duration, songName(&fave.Song),
+				publicURL(fmt.Sprintf("/songs/%d", fave.Song.ID)))
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, url.PathEscape(user.Username)))
+		writeFavesCSV(w, faves)
+	case "", "json":
+		resp := apiFavesResponse{
+			Total: total,
+			Page:  page,
+			Faves: []apiFaveResponse{},
+		}
+		for _, fave := range faves {
+			resp.Faves = append(resp.Faves, apiFaveResponse{
+				Song:  newAPISong(fave.Song),
+				Added: fave.CreatedAt,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json, m3u or csv")
+	}
+}
+
+func writeFavesCSV(w io.Writer, faves []models.Fave) {
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "artist", "title", "added"})
+	for _, fave := range faves {
+		out.Write([]string{
+			strconv.FormatUint(uint64(fave.Song.ID), 10),
+			csvText(fave.Song.Artist.Name),
+			csvText(fave.Song.Title),
+			fave.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	out.Flush()
+}
+
+// csvText stops spreadsheets from running text that looks like a formula,
+// since artists and titles come from uploads.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/santiclause/eden/models"
+)
+
+func TestWriteFavesCSV(t *testing.T) {
+	added := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	song := func(id uint, artist, title string) models.Fave {
+		return models.Fave{
+			Song:      models.Song{ID: id, Title: title, Artist: models.Artist{Name: artist}},
+			CreatedAt: added,
+		}
+	}
+	var b bytes.Buffer
+	writeFavesCSV(&b, []models.Fave{
+		song(1, "Artist", "Song"),
+		song(2, "=HYPERLINK(\"http://example.com\")", "+1"),
+		song(3, "-Minus", "@SUM(A1)"),
+		song(4, "Tab", "\tTitle"),
+		song(5, "A=B", "C-D"),
+	})
+	want := "id,artist,title,added\n" +
+		"1,Artist,Song,2026-01-02T03:04:05Z\n" +
+		"2,\"'=HYPERLINK(\"\"http://example.com\"\")\",'+1,2026-01-02T03:04:05Z\n" +
+		"3,'-Minus,'@SUM(A1),2026-01-02T03:04:05Z\n" +
+		"4,Tab,'\tTitle,2026-01-02T03:04:05Z\n" +
+		"5,A=B,C-D,2026-01-02T03:04:05Z\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	songsPerPage    = 50
+	maxSongsPerPage = 200
+)
+
+type libraryPage struct {
+	Query    string
+	ArtistID uint
+	Sort     string
+	Songs    []librarySong
+	Total    int
+	Page     int
+	Pages    int
+}
+
+func (p libraryPage) Link(sort string, page int) string {
+	v := url.Values{}
+	if p.Query != "" {
+		v.Set("q", p.Query)
+	}
+	if p.ArtistID != 0 {
+		v.Set("artist", strconv.FormatUint(uint64(p.ArtistID), 10))
+	}
+	v.Set("sort", sort)
+	v.Set("page", strconv.Itoa(page))
+	return "?" + v.Encode()
+}
+
+// songQueryFromRequest reads a library search from the query string.
+func songQueryFromRequest(r *http.Request, perPage, maxPerPage int) (songQuery, int) {
+	page := intParam(r, "page", 1, 1<<20)
+	limit := intParam(r, "limit", perPage, maxPerPage)
+	artist, _ := strconv.ParseUint(r.FormValue("artist"), 10, 64)
+	return songQuery{
+		Terms:    r.FormValue("q"),
+		ArtistID: uint(artist),
+		Sort:     r.FormValue("sort"),
+		Offset:   (page - 1) * limit,
+		Limit:    limit,
+	}, page
+}
+
+func library(w http.ResponseWriter, r *http.Request) {
+	q, page := songQueryFromRequest(r, songsPerPage, songsPerPage)
+	if _, ok := librarySorts[q.Sort]; !ok {
+		q.Sort = "artist"
+	}
+	p := libraryPage{
+		Query:    q.Terms,
+		ArtistID: q.ArtistID,
+		Sort:     q.Sort,
+		Page:     page,
+	}
+	var err error
+	if p.Songs, p.Total, err = searchSongs(q); err != nil {
+		log.Printf("Error searching the library: %s\n", err)
+	}
+	p.Pages = (p.Total + songsPerPage - 1) / songsPerPage
+	render(w, r, http.StatusOK, "library", "Library", p)
+}
+
+type apiLibrarySong struct {
+	ID         uint              `json:"id"`
+	Title      string            `json:"title"`
+	Album      string            `json:"album,omitempty"`
+	Duration   uint              `json:"duration,omitempty"`
+	Artist     apiArtistResponse `json:"artist"`
+	Plays      int               `json:"plays"`
+	Faves      int               `json:"faves"`
+	LastPlayed *time.Time        `json:"last_played"`
+	FavedBy    []string          `json:"faved_by,omitempty"`
+}
+
+func newAPILibrarySong(s librarySong) apiLibrarySong {
+	return apiLibrarySong{
+		ID:       s.ID,
+		Title:    s.Title,
+		Album:    s.Album,
+		Duration: s.Duration,
+		Artist: apiArtistResponse{
+			ID:   s.ArtistID,
+			Name: s.ArtistName,
+		},
+		Plays:      s.Plays,
+		Faves:      s.Faves,
+		LastPlayed: s.LastPlayed,
+	}
+}
+
+type apiSongsResponse struct {
+	Total int              `json:"total"`
+	Page  int              `json:"page"`
+	Songs []apiLibrarySong `json:"songs"`
+}
+
+func apiSongs(w http.ResponseWriter, r *http.Request) {
+	q, page := songQueryFromRequest(r, songsPerPage, maxSongsPerPage)
+	songs, total, err := searchSongs(q)
+	if err != nil {
+		log.Printf("Error searching the library: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't search the library")
+		return
+	}
+	resp := apiSongsResponse{
+		Total: total,
+		Page:  page,
+		Songs: []apiLibrarySong{},
+	}
+	for _, song := range songs {
+		resp.Songs = append(resp.Songs, newAPILibrarySong(song))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
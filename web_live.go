@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/santiclause/eden/events"
+)
+
+const (
+	// Messages we'll hold for a client before deciding it can't keep up.
+	liveSendBuffer   = 16
+	livePingInterval = 30 * time.Second
+	// How long a client has to answer a ping.
+	livePongWait  = livePingInterval + 10*time.Second
+	liveWriteWait = 10 * time.Second
+	// Clients have nothing to say to us, so anything big is a mistake.
+	liveMaxMessage = 512
+)
+
+// liveConnections counts the open /ws connections, for /debug/vars.
+var liveConnections = expvar.NewInt("websocket_connections")
+
+var liveUpgrader = websocket.Upgrader{
+	CheckOrigin: liveOriginAllowed,
+}
+
+// liveOriginAllowed lets in our own pages and the CORS origins. Browsers
+// don't apply CORS to WebSockets, so we have to check for ourselves.
+func liveOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return allowedOrigin(origin)
+}
+
+// liveMessage is what we push: what changed, and everything that's playing
+// now, so clients don't have to keep track.
+type liveMessage struct {
+	Type       string                `json:"type"`
+	NowPlaying apiNowPlayingResponse `json:"now_playing"`
+}
+
+var liveEventTypes = map[events.EventType]string{
+	events.SongChangedEvent:      "song",
+	events.DJChangedEvent:        "dj",
+	events.ListenersChangedEvent: "listeners",
+	events.ThreadChangedEvent:    "thread",
+}
+
+// liveHub keeps track of the /ws clients and sends them the radio's events.
+type liveHub struct {
+	clients map[*liveClient]struct{}
+	remover events.Remover
+	mu      sync.Mutex
+}
+
+type liveClient struct {
+	conn *websocket.Conn
+	send chan []byte
+	// Closed when the client goes, however that happens.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var live = &liveHub{
+	clients: make(map[*liveClient]struct{}),
+}
+
+func (h *liveHub) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.remover == nil {
+		var types []events.EventType
+		for t := range liveEventTypes {
+			types = append(types, t)
+		}
+		h.remover = events.Subscribe(h.event, events.OfType(types...))
+	}
+}
+
+// stop says goodbye to every client, since the HTTP server doesn't know
+// about hijacked connections when it shuts down.
+func (h *liveHub) stop() {
+	h.mu.Lock()
+	if h.remover != nil {
+		h.remover.Remove()
+		h.remover = nil
+	}
+	clients := h.clients
+	h.clients = make(map[*liveClient]struct{})
+	h.mu.Unlock()
+	goodbye := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+	for c := range clients {
+		c.conn.WriteControl(websocket.CloseMessage, goodbye, time.Now().Add(liveWriteWait))
+		c.close()
+	}
+}
+
+func (h *liveHub) event(e events.Event) {
+	h.broadcast(liveEventTypes[e.Type()])
+}
+
+func (h *liveHub) broadcast(kind string) {
+	message, err := newLiveMessage(kind)
+	if err != nil {
+		log.Printf("Error encoding live %s message: %s\n", kind, err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case c.send <- message:
+		default:
+			// Too slow. Drop them rather than let them hold anyone else up.
+			delete(h.clients, c)
+			c.close()
+		}
+	}
+}
+
+func newLiveMessage(kind string) ([]byte, error) {
+	return json.Marshal(liveMessage{
+		Type:       kind,
+		NowPlaying: newAPINowPlaying(CurrentlyPlaying()),
+	})
+}
+
+func (h *liveHub) add(c *liveClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+}
+
+func (h *liveHub) remove(c *liveClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+func (c *liveClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// liveFeed upgrades to a WebSocket and streams what's playing.
+func liveFeed(w http.ResponseWriter, r *http.Request) {
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already told the client.
+		return
+	}
+	c := &liveClient{
+		conn: conn,
+		send: make(chan []byte, liveSendBuffer),
+		done: make(chan struct{}),
+	}
+	if hello, err := newLiveMessage("hello"); err == nil {
+		c.send <- hello
+	}
+	live.add(c)
+	liveConnections.Add(1)
+	go c.writeLoop()
+	c.readLoop()
+	live.remove(c)
+	c.close()
+	liveConnections.Add(-1)
+}
+
+// readLoop reads until the client goes away. We don't expect anything but
+// pongs and the close handshake.
+func (c *liveClient) readLoop() {
+	c.conn.SetReadLimit(liveMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *liveClient) writeLoop() {
+	ticker := time.NewTicker(livePingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
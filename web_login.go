@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santiclause/eden/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	loginThrottleWindow = 15 * time.Minute
+	// Failed logins allowed per window, from one address and against one
+	// account.
+	maxLoginFailuresPerIP      = 20
+	maxLoginFailuresPerAccount = 5
+	maxLoginThrottleEntries    = 4096
+)
+
+var (
+	ipThrottle      = newLoginThrottle(maxLoginFailuresPerIP)
+	accountThrottle = newLoginThrottle(maxLoginFailuresPerAccount)
+
+	// Checked against when there's no such user, so that a wrong username
+	// takes as long as a wrong password.
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("eden"), bcrypt.DefaultCost)
+)
+
+// loginThrottle counts failed logins by some key, and says no once there have
+// been too many in the window.
+type loginThrottle struct {
+	limit    int
+	failures map[string]*loginFailures
+	mu       sync.Mutex
+}
+
+type loginFailures struct {
+	count int
+	since time.Time
+}
+
+func newLoginThrottle(limit int) *loginThrottle {
+	return &loginThrottle{
+		limit:    limit,
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+func (t *loginThrottle) allowed(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[key]
+	return !ok || time.Since(f.since) > loginThrottleWindow || f.count < t.limit
+}
+
+func (t *loginThrottle) fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[key]
+	if !ok || time.Since(f.since) > loginThrottleWindow {
+		if len(t.failures) >= maxLoginThrottleEntries {
+			t.prune()
+		}
+		f = &loginFailures{since: time.Now()}
+		t.failures[key] = f
+	}
+	f.count++
+}
+
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+func (t *loginThrottle) prune() {
+	for key, f := range t.failures {
+		if time.Since(f.since) > loginThrottleWindow {
+			delete(t.failures, key)
+		}
+	}
+}
+
+// checkPassword finds the user with the given username and password. Hashes
+// from the old site are $2y$, which bcrypt reads fine; we swap them, and any
+// with a lower cost than we'd use now, for fresh ones while we have the
+// password to hand.
+func checkPassword(username, password string) (*models.User, bool) {
+	var user models.User
+	if db.Where("username = ?", username).First(&user).RecordNotFound() {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return nil, false
+	}
+	if needsRehash(user.Password) {
+		hash, err := hashPassword(password)
+		if err == nil {
+			err = db.Model(&user).Update("password", hash).Error
+		}
+		if err != nil {
+			log.Printf("Error rehashing password for %s: %s\n", user.Username, err)
+		}
+	}
+	return &user, true
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func needsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < bcrypt.DefaultCost || !strings.HasPrefix(hash, "$2a$")
+}
+
+type loginPage struct {
+	Username string
+	Next     string
+	Error    string
+}
+
+func loginForm(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requestSession(r); ok {
+		http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusSeeOther)
+		return
+	}
+	render(w, r, http.StatusOK, "login", "Log in", loginPage{Next: r.FormValue("next")})
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	page := loginPage{
+		Username: strings.TrimSpace(r.PostFormValue("username")),
+		Next:     r.PostFormValue("next"),
+	}
+	ip, account := clientIP(r), strings.ToLower(page.Username)
+	if !ipThrottle.allowed(ip) || !accountThrottle.allowed(account) {
+		page.Error = "Too many failed logins. Try again in a few minutes."
+		render(w, r, http.StatusTooManyRequests, "login", "Log in", page)
+		return
+	}
+	user, ok := checkPassword(page.Username, r.PostFormValue("password"))
+	if !ok {
+		ipThrottle.fail(ip)
+		accountThrottle.fail(account)
+		page.Error = "Wrong username or password."
+		render(w, r, http.StatusUnauthorized, "login", "Log in", page)
+		return
+	}
+	accountThrottle.reset(account)
+	// Don't let anyone who knew the old session carry on with the new one.
+	if old, ok := requestSession(r); ok {
+		db.Delete(old)
+	}
+	if err := newSession(w, r, user); err != nil {
+		log.Printf("Error creating session for %s: %s\n", user.Username, err)
+		page.Error = "Sorry, something went wrong."
+		render(w, r, http.StatusInternalServerError, "login", "Log in", page)
+		return
+	}
+	http.Redirect(w, r, safeRedirect(page.Next), http.StatusSeeOther)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	endSession(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// safeRedirect only lets us send people somewhere on this site.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/santiclause/eden/models"
+)
+
+type queuePage struct {
+	Requests []models.SongRequest
+}
+
+func queue(w http.ResponseWriter, r *http.Request) {
+	var p queuePage
+	var err error
+	if p.Requests, _, err = requestQueue(0); err != nil {
+		log.Printf("Error listing the request queue: %s\n", err)
+	}
+	render(w, r, http.StatusOK, "queue", "Requests", p)
+}
+
+// requestForm handles the request button on a song's page, showing the
+// queue if it worked and the song again if it didn't.
+func requestForm(w http.ResponseWriter, r *http.Request) {
+	session, ok := requestSession(r)
+	if !ok {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape("/songs/"+r.PathValue("id")), http.StatusSeeOther)
+		return
+	}
+	song, ok := lookupSong(w, r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	err := requestSong(session.UserID, song)
+	if reason, ok := err.(requestError); ok {
+		renderSongPage(w, r, http.StatusConflict, songPage{Song: song, RequestError: string(reason)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error requesting song %d for %s: %s\n", song.ID, session.User.Username, err)
+		http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/queue", http.StatusSeeOther)
+}
+
+// quarantineForm lets moderators stop a song being requested, or allow it
+// again.
+func quarantineForm(quarantine bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		song, ok := lookupSong(w, r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		action := "quarantine song"
+		if !quarantine {
+			action = "unquarantine song"
+		}
+		err := transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(song).Update("quarantined", quarantine).Error; err != nil {
+				return err
+			}
+			return audit(tx, r, action, fmt.Sprintf("song %d", song.ID), songName(song))
+		})
+		if err != nil {
+			log.Printf("Error quarantining song %d: %s\n", song.ID, err)
+			http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/songs/%d", song.ID), http.StatusSeeOther)
+	}
+}
+
+type apiRequestResponse struct {
+	ID          uint            `json:"id"`
+	Song        apiSongResponse `json:"song"`
+	RequestedBy string          `json:"requested_by"`
+	RequestedAt time.Time       `json:"requested_at"`
+}
+
+func newAPIRequest(request models.SongRequest) apiRequestResponse {
+	return apiRequestResponse{
+		ID:          request.ID,
+		Song:        newAPISong(request.Song),
+		RequestedBy: request.User.Username,
+		RequestedAt: request.CreatedAt,
+	}
+}
+
+type apiQueueResponse struct {
+	Total    int                  `json:"total"`
+	Requests []apiRequestResponse `json:"requests"`
+}
+
+func apiQueue(w http.ResponseWriter, r *http.Request) {
+	requests, total, err := requestQueue(0)
+	if err != nil {
+		log.Printf("Error listing the request queue: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't list the queue")
+		return
+	}
+	resp := apiQueueResponse{
+		Total:    total,
+		Requests: []apiRequestResponse{},
+	}
+	for _, request := range requests {
+		resp.Requests = append(resp.Requests, newAPIRequest(request))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// apiRequest requests a song for whoever's logged in.
+func apiRequest(w http.ResponseWriter, r *http.Request) {
+	session, _ := requestSession(r)
+	song, ok := lookupSong(w, r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such song")
+		return
+	}
+	err := requestSong(session.UserID, song)
+	if reason, ok := err.(requestError); ok {
+		writeError(w, http.StatusConflict, string(reason))
+		return
+	}
+	if err != nil {
+		log.Printf("Error requesting song %d for %s: %s\n", song.ID, session.User.Username, err)
+		writeError(w, http.StatusInternalServerError, "couldn't request the song")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]bool{"requested": true})
+}
+
+type apiPickedResponse struct {
+	apiRequestResponse
+	// Relative to the library directory.
+	Filename string `json:"filename"`
+}
+
+// apiPickRequest hands the playback backend the next request to play. It
+// answers 204 when there's nothing queued.
+func apiPickRequest(w http.ResponseWriter, r *http.Request) {
+	request, ok, err := pickRequest()
+	if err != nil {
+		log.Printf("Error picking a request: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't pick a request")
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiPickedResponse{
+		apiRequestResponse: newAPIRequest(*request),
+		Filename:           request.Song.Filename,
+	})
+}
+
+// requireBackend lets through the playback backend, which authenticates
+// with config.RequestBackendToken.
+func requireBackend(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := config.RequestBackendToken
+		sent := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte("Bearer "+token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "bad token")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	sessionCookie = "eden_session"
+	// Until someone logs in, their CSRF token lives in a cookie of its own.
+	csrfCookie = "eden_csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+
+	// The most we'll take in a form, besides any files.
+	maxFormBody = 1 << 20
+	// How much of a multipart form we keep in memory before spilling it to
+	// disk.
+	maxFormMemory = 8 << 20
+)
+
+type contextKey int
+
+const sessionKey contextKey = iota
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	// Upload routes read their own bodies, once they know who's sending
+	// them.
+	uploadPaths = make(map[string]bool)
+	// Backend routes take a token instead of a session.
+	backendPaths = make(map[string]bool)
+)
+
+// routePath is the path part of a ServeMux pattern.
+func routePath(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		return pattern[i+1:]
+	}
+	return pattern
+}
+
+// handleUpload registers an upload route. Only logged in users get to send us
+// a file.
+func handleUpload(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	uploadPaths[routePath(pattern)] = true
+	mux.HandleFunc(pattern, requireLogin(receivesUpload(handler)))
+}
+
+// handleBackend registers a route for the playback backend.
+func handleBackend(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	backendPaths[routePath(pattern)] = true
+	mux.HandleFunc(pattern, requireBackend(handler))
+}
+
+// sessions finds who's logged in for every request, and turns away anything
+// that changes state without the right CSRF token.
+func sessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The playback backend has a token rather than cookies, so doesn't
+		// need CSRF protection. We ignore any session it sends.
+		backend := backendPaths[r.URL.Path]
+		if session, ok := lookupSession(r); ok && !backend {
+			r = r.WithContext(context.WithValue(r.Context(), sessionKey, session))
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if uploadPaths[r.URL.Path] && isMultipart(r) {
+				// receivesUpload checks the token.
+				break
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxFormBody)
+			if !backend && !validCSRF(r) {
+				httpError(w, r, http.StatusForbidden, "Your session has expired. Go back, reload the page and try again.")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isMultipart(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// receivesUpload reads the multipart form before the CSRF check, so that an
+// upload that's too big gets told so rather than failing it.
+func receivesUpload(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormBody+config.UploadMaxSize)
+		if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				httpError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("That's too big. Uploads can be up to %d MB.", config.UploadMaxSize>>20))
+			} else {
+				httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+			}
+			return
+		}
+		if !validCSRF(r) {
+			httpError(w, r, http.StatusForbidden, "Your session has expired. Go back, reload the page and try again.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func lookupSession(r *http.Request) (*models.Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, false
+	}
+	var session models.Session
+	if db.Preload("User").Where("token = ? AND expires_at > ?", hashToken(cookie.Value), time.Now()).First(&session).RecordNotFound() {
+		return nil, false
+	}
+	return &session, true
+}
+
+// requestSession returns the session of whoever made the request, if they're
+// logged in.
+func requestSession(r *http.Request) (*models.Session, bool) {
+	session, ok := r.Context().Value(sessionKey).(*models.Session)
+	return session, ok
+}
+
+// newSession logs user in.
+func newSession(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return err
+	}
+	session := models.Session{
+		Token:     hashToken(token),
+		CSRFToken: csrf,
+		UserID:    user.ID,
+		IP:        clientIP(r),
+		ExpiresAt: time.Now().Add(config.SessionLifetime),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   config.HTTPSecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Tidy up sessions nobody came back to.
+	if err := db.Where("expires_at < ?", time.Now()).Delete(models.Session{}).Error; err != nil {
+		log.Printf("Error deleting expired sessions: %s\n", err)
+	}
+	return nil
+}
+
+// endSession logs out whoever made the request.
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if session, ok := requestSession(r); ok {
+		if err := db.Delete(session).Error; err != nil {
+			log.Printf("Error deleting session: %s\n", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   config.HTTPSecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfToken is what a form or script has to send back with anything that
+// changes state. Logged in, it belongs to the session; otherwise we hand out
+// a cookie for it.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if session, ok := requestSession(r); ok {
+		return session.CSRFToken
+	}
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value
+	}
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Error creating CSRF token: %s\n", err)
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   config.HTTPSecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+func validCSRF(r *http.Request) bool {
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = r.PostFormValue(csrfField)
+	}
+	var want string
+	if session, ok := requestSession(r); ok {
+		want = session.CSRFToken
+	} else if cookie, err := r.Cookie(csrfCookie); err == nil {
+		want = cookie.Value
+	}
+	return want != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(want)) == 1
+}
+
+// clientIP is the address the request came from, believing the proxy in front
+// of us if we're told there is one.
+func clientIP(r *http.Request) string {
+	if config.HTTPBehindProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
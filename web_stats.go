@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+const (
+	maxChartLength     = 100
+	maxNeverPlayed     = 200
+	defaultChartLength = 10
+)
+
+type apiDayPlays struct {
+	Day   string `json:"day"`
+	Plays int    `json:"plays"`
+}
+
+type apiHourPlays struct {
+	Hour  int `json:"hour"`
+	Plays int `json:"plays"`
+}
+
+type apiChartSong struct {
+	Song  apiSongResponse `json:"song"`
+	Plays int             `json:"plays"`
+}
+
+type apiChartArtist struct {
+	Artist apiArtistResponse `json:"artist"`
+	Plays  int               `json:"plays"`
+}
+
+// Times are in seconds.
+type apiDJStat struct {
+	DJ             string `json:"dj"`
+	Plays          int    `json:"plays"`
+	Songs          int    `json:"songs"`
+	Sessions       int    `json:"sessions"`
+	OnAir          int64  `json:"on_air"`
+	AverageSession int64  `json:"average_session"`
+	LongestSession int64  `json:"longest_session"`
+}
+
+type apiStatsResponse struct {
+	Days int         `json:"days"`
+	Data interface{} `json:"data"`
+}
+
+func statsDays(r *http.Request) int {
+	return intParam(r, "days", defaultStatsDays, maxStatsDays)
+}
+
+// statsDJ is the user ID of the DJ in ?dj=, or 0 if there isn't one.
+func statsDJ(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	name := r.FormValue("dj")
+	if name == "" {
+		return 0, true
+	}
+	user, ok := lookupUsername(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such user")
+		return 0, false
+	}
+	return user.ID, true
+}
+
+func apiDailyPlays(w http.ResponseWriter, r *http.Request) {
+	days := statsDays(r)
+	rows, err := playsByDay(days)
+	if err != nil {
+		log.Printf("Error fetching daily plays: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't fetch the stats")
+		return
+	}
+	data := []apiDayPlays{}
+	for _, row := range rows {
+		data = append(data, apiDayPlays{Day: row.Day.Format("2006-01-02"), Plays: row.Plays})
+	}
+	writeJSON(w, http.StatusOK, apiStatsResponse{Days: days, Data: data})
+}
+
+func apiHourlyPlays(w http.ResponseWriter, r *http.Request) {
+	days := statsDays(r)
+	rows, err := playsByHour(days)
+	if err != nil {
+		log.Printf("Error fetching hourly plays: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't fetch the stats")
+		return
+	}
+	// Every hour, even the quiet ones, so charts don't have to fill gaps.
+	data := make([]apiHourPlays, 24)
+	for hour := range data {
+		data[hour].Hour = hour
+	}
+	for _, row := range rows {
+		data[row.Hour].Plays = row.Plays
+	}
+	writeJSON(w, http.StatusOK, apiStatsResponse{Days: days, Data: data})
+}
+
+func apiTopSongs(w http.ResponseWriter, r *http.Request) {
+	days := statsDays(r)
+	dj, ok := statsDJ(w, r)
+	if !ok {
+		return
+	}
+	songs, err := topSongs(days, dj, intParam(r, "limit", defaultChartLength, maxChartLength))
+	if err != nil {
+		log.Printf("Error fetching top songs: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't fetch the stats")
+		return
+	}
+	data := []apiChartSong{}
+	for _, song := range songs {
+		data = append(data, apiChartSong{
+			Song: apiSongResponse{
+				ID:    song.ID,
+				Title: song.Title,
+				Artist: &apiArtistResponse{
+					ID:   song.ArtistID,
+					Name: song.ArtistName,
+				},
+			},
+			Plays: song.Plays,
+		})
+	}
+	writeJSON(w, http.StatusOK, apiStatsResponse{Days: days, Data: data})
+}
+
+func apiTopArtists(w http.ResponseWriter, r *http.Request) {
+	days := statsDays(r)
+	artists, err := topArtists(days, intParam(r, "limit", defaultChartLength, maxChartLength))
+	if err != nil {
+		log.Printf("Error fetching top artists: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't fetch the stats")
+		return
+	}
+	data := []apiChartArtist{}
+	for _, artist := range artists {
+		data = append(data, apiChartArtist{
+			Artist: apiArtistResponse{ID: artist.ID, Name: artist.Name},
+			Plays:  artist.Plays,
+		})
+	}
+	writeJSON(w, http.StatusOK, apiStatsResponse{Days: days, Data: data})
+}
+
+// apiDJStats lists every DJ's stats, or just one's with ?dj=name.
+func apiDJStats(w http.ResponseWriter, r *http.Request) {
+	days := statsDays(r)
+	dj, ok := statsDJ(w, r)
+	if !ok {
+		return
+	}
+	stats, err := djStats(days, dj)
+	if err != nil {
+		log.Printf("Error fetching DJ stats: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't fetch the stats")
+		return
+	}
+	data := []apiDJStat{}
+	for _, s := range stats {
+		data = append(data, apiDJStat{
+			DJ:             s.Username,
+			Plays:          s.Plays,
+			Songs:          s.Songs,
+			Sessions:       s.Sessions,
+			OnAir:          s.OnAir,
+			AverageSession: s.AverageSession(),
+			LongestSession: s.Longest,
+		})
+	}
+	writeJSON(w, http.StatusOK, apiStatsResponse{Days: days, Data: data})
+}
+
+func apiNeverPlayed(w http.ResponseWriter, r *http.Request) {
+	page := intParam(r, "page", 1, 1<<20)
+	limit := intParam(r, "limit", songsPerPage, maxNeverPlayed)
+	songs, total, err := neverPlayed((page-1)*limit, limit)
+	if err != nil {
+		log.Printf("Error listing unplayed songs: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "couldn't list the songs")
+		return
+	}
+	resp := apiSongsResponse{
+		Total: total,
+		Page:  page,
+		Songs: []apiLibrarySong{},
+	}
+	for _, song := range songs {
+		resp.Songs = append(resp.Songs, newAPILibrarySong(song))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
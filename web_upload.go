@@ -0,0 +1,426 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/santiclause/eden/models"
+)
+
+const (
+	moderatorPermission = "moderate"
+	uploadsListed       = 20
+	maxTagLength        = 191
+	// How many names moveToLibrary tries before giving up.
+	maxLibraryNameAttempts = 10
+)
+
+// uploadError is an upload we turned down, and the status to say so with.
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+func rejectUpload(status int, format string, args ...interface{}) *uploadError {
+	return &uploadError{status, fmt.Sprintf(format, args...)}
+}
+
+// receiveUpload checks the file in the request's "file" field and, if it's
+// something we'd play, queues it for a moderator. Tags in the file can be
+// overridden with the title, artist and album fields.
+func receiveUpload(r *http.Request, user *models.User) (*models.Upload, *uploadError) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, rejectUpload(http.StatusBadRequest, "Choose a file to upload.")
+	}
+	defer file.Close()
+	if header.Size > config.UploadMaxSize {
+		return nil, rejectUpload(http.StatusRequestEntityTooLarge, "That's too big. Uploads can be up to %d MB.", config.UploadMaxSize>>20)
+	}
+	info, err := probeAudio(file, header.Size)
+	if err == errUnknownFormat {
+		return nil, rejectUpload(http.StatusUnsupportedMediaType, "That isn't an MP3, Ogg Vorbis, Opus or FLAC file.")
+	} else if err != nil {
+		return nil, rejectUpload(http.StatusUnprocessableEntity, "Couldn't read that file: %s.", err)
+	}
+	if info.Duration <= 0 {
+		return nil, rejectUpload(http.StatusUnprocessableEntity, "Couldn't work out how long that song is.")
+	}
+	if info.Duration > config.UploadMaxDuration {
+		return nil, rejectUpload(http.StatusUnprocessableEntity, "That's too long. Songs can be up to %s.", config.UploadMaxDuration)
+	}
+	for field, value := range map[*string]string{
+		&info.Title:  r.FormValue("title"),
+		&info.Artist: r.FormValue("artist"),
+		&info.Album:  r.FormValue("album"),
+	} {
+		if value = strings.TrimSpace(value); value != "" {
+			*field = value
+		}
+		*field = truncate(*field, maxTagLength)
+	}
+	if info.Title == "" || info.Artist == "" {
+		return nil, rejectUpload(http.StatusUnprocessableEntity, "That file doesn't say what it is. Fill in the title and artist.")
+	}
+	if dupe, ok := findDuplicate(info.Hash); ok {
+		return nil, rejectUpload(http.StatusConflict, "We've already got that one: %s.", dupe)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error rewinding upload: %s\n", err)
+		return nil, rejectUpload(http.StatusInternalServerError, "Sorry, something went wrong.")
+	}
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Error naming upload: %s\n", err)
+		return nil, rejectUpload(http.StatusInternalServerError, "Sorry, something went wrong.")
+	}
+	upload := models.Upload{
+		UserID:       user.ID,
+		Filename:     token[:32] + audioExtensions[info.Format],
+		OriginalName: truncate(filepath.Base(header.Filename), maxTagLength),
+		Format:       info.Format,
+		Title:        info.Title,
+		Artist:       info.Artist,
+		Album:        info.Album,
+		Duration:     uint(info.Duration / time.Second),
+		Size:         header.Size,
+		Hash:         info.Hash,
+		Status:       models.UploadPending,
+	}
+	if err := saveFile(file, filepath.Join(config.UploadDir, upload.Filename)); err != nil {
+		log.Printf("Error saving upload %s: %s\n", upload.Filename, err)
+		return nil, rejectUpload(http.StatusInternalServerError, "Sorry, something went wrong.")
+	}
+	if err := db.Create(&upload).Error; err != nil {
+		log.Printf("Error recording upload %s: %s\n", upload.Filename, err)
+		os.Remove(filepath.Join(config.UploadDir, upload.Filename))
+		return nil, rejectUpload(http.StatusInternalServerError, "Sorry, something went wrong.")
+	}
+	return &upload, nil
+}
+
+// findDuplicate looks for the same audio in the library or the queue.
+func findDuplicate(hash string) (string, bool) {
+	if dupe, ok := findLibraryDuplicate(hash); ok {
+		return dupe, true
+	}
+	var upload models.Upload
+	if !db.Where("hash = ? AND status = ?", hash, models.UploadPending).First(&upload).RecordNotFound() {
+		return fmt.Sprintf("%s - %s, which is waiting to be approved", upload.Artist, upload.Title), true
+	}
+	return "", false
+}
+
+func saveFile(r io.Reader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// moveFile moves a file, copying it if it has to cross filesystems. Unlike
+// os.Rename it won't replace a file that's already there, and fails with
+// fs.ErrExist instead.
+func moveFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	err := os.Link(from, to)
+	if err == nil {
+		return os.Remove(from)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	f, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := saveFile(f, to); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+type uploadPage struct {
+	Uploads []models.Upload
+	Error   string
+	Added   *models.Upload
+}
+
+func renderUploadPage(w http.ResponseWriter, r *http.Request, status int, p uploadPage) {
+	session, _ := requestSession(r)
+	if err := db.Where("user_id = ?", session.UserID).Order("id desc").Limit(uploadsListed).Find(&p.Uploads).Error; err != nil {
+		log.Printf("Error listing uploads for %s: %s\n", session.User.Username, err)
+	}
+	render(w, r, status, "upload", "Upload", p)
+}
+
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requestSession(r); !ok {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeError(w, http.StatusUnauthorized, "not logged in")
+			} else {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			}
+			return
+		}
+		next(w, r)
+	}
+}
+
+func uploadForm(w http.ResponseWriter, r *http.Request) {
+	renderUploadPage(w, r, http.StatusOK, uploadPage{})
+}
+
+func upload(w http.ResponseWriter, r *http.Request) {
+	session, _ := requestSession(r)
+	added, err := receiveUpload(r, &session.User)
+	if err != nil {
+		renderUploadPage(w, r, err.status, uploadPage{Error: err.message})
+		return
+	}
+	renderUploadPage(w, r, http.StatusCreated, uploadPage{Added: added})
+}
+
+type apiUploadResponse struct {
+	ID       uint   `json:"id"`
+	Status   string `json:"status"`
+	Format   string `json:"format"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Duration uint   `json:"duration"`
+}
+
+func apiUpload(w http.ResponseWriter, r *http.Request) {
+	session, _ := requestSession(r)
+	upload, err := receiveUpload(r, &session.User)
+	if err != nil {
+		writeError(w, err.status, err.message)
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiUploadResponse{
+		ID:       upload.ID,
+		Status:   upload.Status,
+		Format:   upload.Format,
+		Title:    upload.Title,
+		Artist:   upload.Artist,
+		Album:    upload.Album,
+		Duration: upload.Duration,
+	})
+}
+
+type moderationPage struct {
+	Uploads []models.Upload
+	Error   string
+}
+
+func renderModeration(w http.ResponseWriter, r *http.Request, status int, message string) {
+	p := moderationPage{Error: message}
+	if err := db.Preload("User").Where("status = ?", models.UploadPending).Order("id").Find(&p.Uploads).Error; err != nil {
+		log.Printf("Error listing pending uploads: %s\n", err)
+	}
+	render(w, r, status, "admin_uploads", "Uploads", p)
+}
+
+func adminUploads(w http.ResponseWriter, r *http.Request) {
+	renderModeration(w, r, http.StatusOK, "")
+}
+
+func pendingUpload(w http.ResponseWriter, r *http.Request) (*models.Upload, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	var upload models.Upload
+	if err != nil || db.Where("status = ?", models.UploadPending).First(&upload, id).RecordNotFound() {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return &upload, true
+}
+
+// adminUploadFile lets moderators listen before they approve.
+func adminUploadFile(w http.ResponseWriter, r *http.Request) {
+	if upload, ok := pendingUpload(w, r); ok {
+		http.ServeFile(w, r, filepath.Join(config.UploadDir, upload.Filename))
+	}
+}
+
+// adminApproveUpload moves an upload into the library, with whatever
+// corrections the moderator made to its tags.
+func adminApproveUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := pendingUpload(w, r)
+	if !ok {
+		return
+	}
+	for field, value := range map[*string]string{
+		&upload.Title:  r.PostFormValue("title"),
+		&upload.Artist: r.PostFormValue("artist"),
+		&upload.Album:  r.PostFormValue("album"),
+	} {
+		if value = strings.TrimSpace(value); value != "" {
+			*field = truncate(value, maxTagLength)
+		}
+	}
+	if dupe, ok := findLibraryDuplicate(upload.Hash); ok {
+		renderModeration(w, r, http.StatusConflict, fmt.Sprintf("%s - %s is already in the library as %s.", upload.Artist, upload.Title, dupe))
+		return
+	}
+
+	artist := models.Artist{Name: upload.Artist}
+	if err := db.Where(artist).FirstOrCreate(&artist).Error; err != nil {
+		log.Printf("Error finding artist %s: %s\n", upload.Artist, err)
+		renderModeration(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+		return
+	}
+	filename, err := moveToLibrary(upload)
+	if err != nil {
+		log.Printf("Error moving upload %s into the library: %s\n", upload.Filename, err)
+		renderModeration(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+		return
+	}
+	song := models.Song{
+		Filename: filename,
+		Title:    upload.Title,
+		ArtistID: artist.ID,
+		Album:    upload.Album,
+		Duration: upload.Duration,
+		Hash:     &upload.Hash,
+	}
+	err = transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&song).Error; err != nil {
+			return err
+		}
+		if err := reviewUpload(tx, r, upload, models.UploadApproved, &song.ID); err != nil {
+			return err
+		}
+		return audit(tx, r, "approve upload", fmt.Sprintf("upload %d", upload.ID), fmt.Sprintf("%s - %s, as song %d", upload.Artist, upload.Title, song.ID))
+	})
+	if err != nil {
+		log.Printf("Error adding %s to the library: %s\n", filename, err)
+		// Put it back so it can be tried again.
+		moveFile(filepath.Join(config.LibraryDir, filename), filepath.Join(config.UploadDir, upload.Filename))
+		renderModeration(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+		return
+	}
+	http.Redirect(w, r, "/admin/uploads", http.StatusSeeOther)
+}
+
+func findLibraryDuplicate(hash string) (string, bool) {
+	var song models.Song
+	if db.Preload("Artist").Where("hash = ?", hash).First(&song).RecordNotFound() {
+		return "", false
+	}
+	return songName(&song), true
+}
+
+func adminRejectUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := pendingUpload(w, r)
+	if !ok {
+		return
+	}
+	detail := fmt.Sprintf("%s - %s", upload.Artist, upload.Title)
+	if reason := strings.TrimSpace(r.PostFormValue("reason")); reason != "" {
+		detail += ": " + reason
+	}
+	err := transaction(func(tx *gorm.DB) error {
+		if err := reviewUpload(tx, r, upload, models.UploadRejected, nil); err != nil {
+			return err
+		}
+		return audit(tx, r, "reject upload", fmt.Sprintf("upload %d", upload.ID), detail)
+	})
+	if err != nil {
+		log.Printf("Error rejecting upload %d: %s\n", upload.ID, err)
+		renderModeration(w, r, http.StatusInternalServerError, "Sorry, something went wrong.")
+		return
+	}
+	if err := os.Remove(filepath.Join(config.UploadDir, upload.Filename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error deleting upload %s: %s\n", upload.Filename, err)
+	}
+	http.Redirect(w, r, "/admin/uploads", http.StatusSeeOther)
+}
+
+func reviewUpload(tx *gorm.DB, r *http.Request, upload *models.Upload, status string, songID *uint) error {
+	session, _ := requestSession(r)
+	now := time.Now()
+	return tx.Model(upload).Updates(map[string]interface{}{
+		"status":      status,
+		"title":       upload.Title,
+		"artist":      upload.Artist,
+		"album":       upload.Album,
+		"reviewer_id": session.UserID,
+		"reviewed_at": now,
+		"song_id":     songID,
+	}).Error
+}
+
+// moveToLibrary moves an approved upload into the library under the first
+// of its libraryFilenames that's free, and returns that name.
+func moveToLibrary(upload *models.Upload) (string, error) {
+	from := filepath.Join(config.UploadDir, upload.Filename)
+	for attempt := 0; attempt < maxLibraryNameAttempts; attempt++ {
+		name := libraryFilename(upload, attempt)
+		err := moveFile(from, filepath.Join(config.LibraryDir, name))
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name in the library for upload %d", upload.ID)
+}
+
+// libraryFilename names a song in the library after what it is. Later
+// attempts, for when that's taken, add the upload ID and then a count.
+func libraryFilename(upload *models.Upload, attempt int) string {
+	clean := strings.NewReplacer("/", "-", "\\", "-", "\x00", "", ":", "-").Replace(upload.Artist + " - " + upload.Title)
+	clean = strings.Trim(truncateBytes(clean, 150), ". ")
+	ext := audioExtensions[upload.Format]
+	switch attempt {
+	case 0:
+		return clean + ext
+	case 1:
+		return fmt.Sprintf("%s (%d)%s", clean, upload.ID, ext)
+	}
+	return fmt.Sprintf("%s (%d-%d)%s", clean, upload.ID, attempt, ext)
+}
+
+// truncateBytes cuts s down to at most max bytes without splitting a
+// character, since filesystems limit names in bytes.
+func truncateBytes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/santiclause/eden/models"
+)
+
+func TestMoveToLibrary(t *testing.T) {
+	oldUploads, oldLibrary := config.UploadDir, config.LibraryDir
+	config.UploadDir, config.LibraryDir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.UploadDir, config.LibraryDir = oldUploads, oldLibrary
+	}()
+	// Someone's already got the second name upload 3 would try.
+	if err := os.WriteFile(filepath.Join(config.LibraryDir, "Artist - Song (3).mp3"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id   uint
+		want string
+	}{
+		{1, "Artist - Song.mp3"},
+		{2, "Artist - Song (2).mp3"},
+		{3, "Artist - Song (3-2).mp3"},
+	}
+	for _, test := range tests {
+		upload := &models.Upload{ID: test.id, Filename: filepath.Base(test.want) + ".upload", Artist: "Artist", Title: "Song", Format: "mp3"}
+		contents := []byte(test.want)
+		if err := os.WriteFile(filepath.Join(config.UploadDir, upload.Filename), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		name, err := moveToLibrary(upload)
+		if err != nil {
+			t.Fatalf("upload %d: %s", test.id, err)
+		}
+		if name != test.want {
+			t.Errorf("upload %d went to %q, want %q", test.id, name, test.want)
+		}
+		got, err := os.ReadFile(filepath.Join(config.LibraryDir, name))
+		if err != nil || string(got) != string(contents) {
+			t.Errorf("upload %d: library file has %q, %v", test.id, got, err)
+		}
+		if _, err := os.Stat(filepath.Join(config.UploadDir, upload.Filename)); !os.IsNotExist(err) {
+			t.Errorf("upload %d is still in the upload directory", test.id)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(config.LibraryDir, "Artist - Song (3).mp3")); string(got) != "other" {
+		t.Errorf("overwrote a file that was already there with %q", got)
+	}
+}